@@ -0,0 +1,338 @@
+package main
+
+import "bufio"
+import "compress/gzip"
+import "crypto/subtle"
+import "encoding/json"
+import "fmt"
+import "io"
+import "net/http"
+import "os"
+import "path"
+import "strconv"
+import "strings"
+
+func (server vermServer) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	if server.AdminToken == "" {
+		http.Error(w, "The admin API is disabled; use the admin-token option to enable it", 403)
+		return
+	}
+	if !server.adminAuthorized(req) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="verm"`)
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	switch req.URL.Path {
+	case AdminDeadLettersPath:
+		server.serveDeadLetters(w, req)
+
+	case AdminResyncPath:
+		server.serveAdminResync(w, req)
+
+	case AdminReplicatePath:
+		server.serveAdminReplicate(w, req)
+
+	case AdminPausePath, AdminResumePath:
+		server.serveAdminPause(w, req)
+
+	case AdminQueuePath:
+		server.serveAdminQueue(w, req)
+
+	case AdminListPath:
+		server.serveAdminList(w, req)
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (server vermServer) adminAuthorized(req *http.Request) bool {
+	// the token must be given using the Bearer scheme, whose name is case-insensitive
+	authorization := req.Header.Get("Authorization")
+	space := strings.IndexByte(authorization, ' ')
+	if space < 0 || !strings.EqualFold(authorization[:space], "Bearer") {
+		return false
+	}
+	token := strings.TrimLeft(authorization[space+1:], " ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(server.AdminToken)) == 1
+}
+
+// adminTargets returns the replication targets named by the target query parameter, or all of
+// them if there's no such parameter.
+func (server vermServer) adminTargets(req *http.Request) ([]*ReplicationTarget, error) {
+	names := req.URL.Query()["target"]
+	if len(names) == 0 {
+		return server.Targets.targets, nil
+	}
+
+	var targets []*ReplicationTarget
+	for _, name := range names {
+		target := server.Targets.find(name)
+		if target == nil {
+			return nil, fmt.Errorf("%s is not a configured replication target", name)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// adminLocations reads a list of locations, one per line, from the request body.
+func adminLocations(req *http.Request) ([]string, error) {
+	var locations []string
+	scanner := bufio.NewScanner(req.Body)
+	for scanner.Scan() {
+		location := strings.TrimSpace(scanner.Text())
+		if location != "" {
+			locations = append(locations, location)
+		}
+	}
+	return locations, scanner.Err()
+}
+
+func serveJSON(w http.ResponseWriter, value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(append(data, '\n'))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't write response: %s\n", err.Error())
+	}
+}
+
+// GET lists the dead-lettered files for each target.  POST with action=retry puts the files
+// listed in the request body (or all of them, if the body is empty) back on the replication
+// queue; POST with action=discard forgets about the files listed, or all of them if all=1 is
+// given, so that a request with a missing body can't throw away the whole list by mistake.
+func (server vermServer) serveDeadLetters(w http.ResponseWriter, req *http.Request) {
+	targets, err := server.adminTargets(req)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		result := make(map[string][]deadLetter)
+		for _, target := range targets {
+			result[target.hostname+":"+target.port] = target.deadLetters.list()
+		}
+		serveJSON(w, result)
+
+	case "POST":
+		locations, err := adminLocations(req)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		action := req.URL.Query().Get("action")
+		if action != "retry" && action != "discard" {
+			http.Error(w, "action must be retry or discard", 400)
+			return
+		}
+		if action == "discard" && len(locations) == 0 && req.URL.Query().Get("all") != "1" {
+			http.Error(w, "List the locations to discard, or give all=1 to discard them all", 400)
+			return
+		}
+
+		result := make(map[string][]string)
+		for _, target := range targets {
+			removed := target.deadLetters.remove(locations)
+			if action == "retry" {
+				for _, location := range removed {
+					target.enqueueNewFile(location)
+				}
+			}
+			result[target.hostname+":"+target.port] = removed
+		}
+		serveJSON(w, result)
+
+	default:
+		http.Error(w, "Method not supported", 405)
+	}
+}
+
+// POST resyncs the given directory and its subdirectories to each target, or if no directory
+// is given, queues a full resync just as SIGUSR1 would (but only for the given targets).
+func (server vermServer) serveAdminResync(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not supported", 405)
+		return
+	}
+
+	targets, err := server.adminTargets(req)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	directory := ""
+	if value := req.URL.Query().Get("directory"); value != "" {
+		directory = path.Clean("/" + value)
+		if directory == "/" {
+			directory = ""
+		}
+	}
+	if directory != "" {
+		stat, err := os.Stat(server.RootDataDir + directory)
+		if err != nil || !stat.IsDir() || server.isStatePath(directory) {
+			http.Error(w, "No such directory "+directory, 404)
+			return
+		}
+	}
+
+	result := make(map[string]string)
+	for _, target := range targets {
+		if directory == "" {
+			target.enqueueResync()
+			result[target.hostname+":"+target.port] = "/"
+		} else if target.enqueueSubtreeResync(directory) {
+			result[target.hostname+":"+target.port] = directory
+		} else {
+			http.Error(w, "Too many resyncs already queued for "+target.hostname+":"+target.port, 503)
+			return
+		}
+	}
+	serveJSON(w, result)
+}
+
+// POST queues the files listed in the request body to be replicated to each target, whether or
+// not they already have them.
+func (server vermServer) serveAdminReplicate(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not supported", 405)
+		return
+	}
+
+	targets, err := server.adminTargets(req)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	locations, err := adminLocations(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// check them all before queueing any, so the request can simply be fixed and retried
+	for index, location := range locations {
+		location = path.Clean("/" + location)
+		if !(pathExists(server.RootDataDir, location) || pathExists(server.RootDataDir, location+".gz")) || server.isStatePath(location) {
+			http.Error(w, "No such file "+location, 404)
+			return
+		}
+		locations[index] = location
+	}
+
+	result := make(map[string][]string)
+	for _, target := range targets {
+		for _, location := range locations {
+			target.enqueueNewFile(location)
+		}
+		result[target.hostname+":"+target.port] = append([]string{}, locations...)
+	}
+	serveJSON(w, result)
+}
+
+// POST to the pause path stops the workers for each target taking more jobs off its queue until
+// the resume path is posted to.
+func (server vermServer) serveAdminPause(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not supported", 405)
+		return
+	}
+
+	targets, err := server.adminTargets(req)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	result := make(map[string]string)
+	for _, target := range targets {
+		if req.URL.Path == AdminPausePath {
+			target.pause()
+			result[target.hostname+":"+target.port] = "paused"
+		} else {
+			target.resume()
+			result[target.hostname+":"+target.port] = "running"
+		}
+	}
+	serveJSON(w, result)
+}
+
+// GET shows what's waiting in each target's queues and what each of its workers is doing.
+func (server vermServer) serveAdminQueue(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, "Method not supported", 405)
+		return
+	}
+
+	targets, err := server.adminTargets(req)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	sampleSize := AdminQueueSampleSize
+	if value := req.URL.Query().Get("limit"); value != "" {
+		sampleSize, err = strconv.Atoi(value)
+		if err != nil || sampleSize < 0 {
+			http.Error(w, "limit must be a non-negative number", 400)
+			return
+		}
+	}
+
+	result := make(map[string]replicationQueueStatus)
+	for _, target := range targets {
+		result[target.hostname+":"+target.port] = target.queueStatus(sampleSize)
+	}
+	serveJSON(w, result)
+}
+
+// GET lists the locations of all the files under the given directory (or all files, if none is
+// given), one per line, in the order given by compareLocations.  locations are not normally
+// discoverable, so this is only available through the admin API.
+func (server vermServer) serveAdminList(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, "Method not supported", 405)
+		return
+	}
+
+	directory := strings.TrimSuffix(path.Clean("/"+req.URL.Query().Get("directory")), "/")
+	if server.isStatePath(directory) {
+		http.Error(w, "No such directory "+directory, 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	var output io.Writer = w
+	if gzipAccepted(req) {
+		w.Header().Set("Content-Encoding", "gzip")
+		compressor := gzip.NewWriter(w)
+		defer compressor.Close()
+		output = compressor
+	}
+	w.WriteHeader(http.StatusOK)
+	if req.Method == "HEAD" {
+		return
+	}
+
+	err := listLocations(server.RootDataDir, directory, server.isStatePath, func(location string) error {
+		_, err := io.WriteString(output, location+"\r\n")
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing %s: %s\n", directory, err.Error())
+		// we've already sent the response code, so abort the response rather than finishing it
+		// normally; otherwise the client would think it had the whole list
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import "archive/tar"
+import "archive/zip"
+import "compress/gzip"
+import "fmt"
+import "io"
+import "net/http"
+import "path"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "github.com/willbryant/verm/mimeext"
+
+// members of stored zip and tar archives can be served individually, so that clients that only
+// need one file don't have to download the whole archive.  they're requested using the archive's
+// location followed by /!/ and the member's path within the archive, for example
+// /reports/Ab/cdef....zip/!/index.html.  members of zip archives that are stored uncompressed can
+// be requested in byte ranges; other members are streamed in full.
+
+// splitArchiveMemberPath splits a path requesting an archive member into the archive's location
+// and the member's path, returning false if the path isn't for an archive member.
+func splitArchiveMemberPath(requested string) (string, string, bool) {
+	index := strings.Index(requested, ArchiveMemberSeparator)
+	if index < 0 {
+		return "", "", false
+	}
+	return requested[:index], requested[index+len(ArchiveMemberSeparator):], true
+}
+
+func (server vermServer) serveArchiveMember(w http.ResponseWriter, req *http.Request, location, member string) {
+	file, stat, err := server.openFile(location)
+	storedCompressed := false
+	if err != nil {
+		file, stat, err = server.openFile(location + ".gz")
+		storedCompressed = true
+	}
+	if err != nil && server.shouldForwardRead(req) && server.forwardRead(w, req) {
+		server.Statistics.GetRequests.Add(1)
+		server.Statistics.GetRequestsFoundOnReplica.Add(1)
+		return
+	}
+	if err != nil {
+		server.Statistics.GetRequests.Add(1)
+		server.Statistics.GetRequestsNotFound.Add(1)
+		http.NotFound(w, req)
+		return
+	}
+	defer file.Close()
+	defer server.Statistics.GetRequests.Add(1)
+
+	switch strings.ToLower(path.Ext(location)) {
+	case ".zip":
+		server.serveZipMember(w, req, location, file, stat.Size(), storedCompressed, member, stat.ModTime())
+	case ".tar":
+		server.serveTarMember(w, req, file, storedCompressed, member, stat.ModTime())
+	default:
+		server.Statistics.GetRequestsNotFound.Add(1)
+		http.Error(w, location+" isn't a zip or tar archive", 404)
+	}
+}
+
+func (server vermServer) serveZipMember(w http.ResponseWriter, req *http.Request, location string, file http.File, size int64, storedCompressed bool, member string, modTime time.Time) {
+	// zip archives are read starting from the directory at the end, so we need to be able to seek
+	// in the uncompressed contents
+	var archive io.ReaderAt
+	if storedCompressed {
+		index, err := server.GzipIndexer.index(location, server.RootDataDir+location+".gz", size, true)
+		if err != nil {
+			http.Error(w, "Couldn't decompress archive "+err.Error(), 500)
+			return
+		}
+		defer index.Close()
+
+		seeker := &gzipIndexSeeker{compressed: file, index: index}
+		defer seeker.Close()
+		archive, size = &seekingReaderAt{input: seeker}, index.Size
+	} else if readerAt, ok := file.(io.ReaderAt); ok {
+		archive = readerAt
+	} else {
+		archive = &seekingReaderAt{input: file}
+	}
+
+	reader, err := zip.NewReader(archive, size)
+	if err != nil {
+		http.Error(w, "Couldn't read archive "+err.Error(), 500)
+		return
+	}
+
+	for _, entry := range reader.File {
+		if entry.Name != member || entry.Mode().IsDir() {
+			continue
+		}
+
+		if entry.Method == zip.Store {
+			offset, err := entry.DataOffset()
+			if err != nil {
+				http.Error(w, "Couldn't read archive "+err.Error(), 500)
+				return
+			}
+			if server.setArchiveMemberHeaders(w, req, member, modTime) {
+				return
+			}
+			serveContent(w, req, int64(entry.UncompressedSize64), io.NewSectionReader(archive, offset, int64(entry.UncompressedSize64)))
+			return
+		}
+
+		content, err := entry.Open()
+		if err != nil {
+			http.Error(w, "Couldn't read archive "+err.Error(), 500)
+			return
+		}
+		defer content.Close()
+		if server.setArchiveMemberHeaders(w, req, member, modTime) {
+			return
+		}
+		serveArchiveMemberStream(w, req, int64(entry.UncompressedSize64), content)
+		return
+	}
+
+	server.Statistics.GetRequestsNotFound.Add(1)
+	http.Error(w, member+" isn't in the archive", 404)
+}
+
+func (server vermServer) serveTarMember(w http.ResponseWriter, req *http.Request, file http.File, storedCompressed bool, member string, modTime time.Time) {
+	var archive io.Reader = file
+	if storedCompressed {
+		uncompressed, err := gzip.NewReader(file)
+		if err != nil {
+			http.Error(w, "Couldn't decompress archive "+err.Error(), 500)
+			return
+		}
+		defer uncompressed.Close()
+		archive = uncompressed
+	}
+
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, "Couldn't read archive "+err.Error(), 500)
+			return
+		}
+
+		if strings.TrimPrefix(header.Name, "./") == member && header.FileInfo().Mode().IsRegular() {
+			if server.setArchiveMemberHeaders(w, req, member, modTime) {
+				return
+			}
+			serveArchiveMemberStream(w, req, header.Size, reader)
+			return
+		}
+	}
+
+	server.Statistics.GetRequestsNotFound.Add(1)
+	http.Error(w, member+" isn't in the archive", 404)
+}
+
+// setArchiveMemberHeaders sets the headers for an archive member and checks the client's
+// conditional headers, returning true if the response has already been sent.  archives never
+// change, so we use the archive's modification time for all of their members.
+func (server vermServer) setArchiveMemberHeaders(w http.ResponseWriter, req *http.Request, member string, modTime time.Time) bool {
+	contentType := mimeext.TypeByExtension(path.Ext(member))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	setContentDisposition(w, req, path.Base(member))
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	if server.CacheMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", server.CacheMaxAge))
+	}
+	return checkPreconditions(w, req, modTime)
+}
+
+// serveArchiveMemberStream sends the contents of a member that we can only read from the start.
+func serveArchiveMemberStream(w http.ResponseWriter, req *http.Request, size int64, content io.Reader) {
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == "HEAD" {
+		return
+	}
+
+	_, err := io.CopyN(w, content, size)
+	if err != nil {
+		// we've already sent the response code, so abort the response rather than finishing it
+		// normally; otherwise the client would think it had the whole file
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// seekingReaderAt reads from the given offsets in a file that we can only seek in, such as a file
+// stored gzip-encoded.
+type seekingReaderAt struct {
+	mutex sync.Mutex
+	input io.ReadSeeker
+}
+
+func (reader *seekingReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	reader.mutex.Lock()
+	defer reader.mutex.Unlock()
+
+	_, err := reader.input.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(reader.input, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,299 @@
+package main
+
+import "archive/tar"
+import "archive/zip"
+import "compress/gzip"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "path"
+import "path/filepath"
+import "strings"
+import "time"
+import "github.com/willbryant/verm/mimeext"
+
+// bundles let clients download many files at once as a single zip or tar archive, such as all the
+// attachments for a case.  the files are given by location parameters in the query string or in a
+// form-encoded POST body, each optionally followed by a name parameter giving its name in the
+// archive.  the archive is built as it's sent, so if a file can't be read part-way through, we
+// abort the response rather than finishing it, so the client doesn't think it has everything.
+
+type bundleMember struct {
+	name     string
+	modTime  time.Time
+	size     int64 // -1 if we don't know it without reading the contents
+	compress bool  // if the contents are worth compressing
+	content  io.Reader
+	closers  []io.Closer
+}
+
+func (member *bundleMember) Close() {
+	for index := len(member.closers) - 1; index >= 0; index-- {
+		member.closers[index].Close()
+	}
+}
+
+type bundleWriter interface {
+	add(member *bundleMember) error
+	Close() error
+}
+
+func (server vermServer) serveBundle(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" && req.Method != "POST" {
+		http.Error(w, "Method not supported", 405)
+		return
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	locations := req.Form["location"]
+	names := req.Form["name"]
+	if len(locations) == 0 {
+		http.Error(w, "No locations given", 400)
+		return
+	} else if len(locations) > BundleMaxFiles {
+		http.Error(w, fmt.Sprintf("Can't bundle more than %d files", BundleMaxFiles), 400)
+		return
+	} else if len(names) != 0 && len(names) != len(locations) {
+		http.Error(w, "A name must be given for each location, or for none of them", 400)
+		return
+	}
+
+	format := req.Form.Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "tar" {
+		http.Error(w, "Unsupported format "+format, 400)
+		return
+	}
+
+	// we can't send a 404 once we've started, so check that we have all the files, or that we might be
+	// able to fetch them from the replicas, first
+	var missing []string
+	forward := len(server.Targets.targets) != 0 && req.Form.Get("forward") != "0"
+	for index, location := range locations {
+		locations[index] = path.Clean("/" + location)
+		location = locations[index]
+		if server.isStatePath(location) ||
+			(!pathExists(server.RootDataDir, location) && !pathExists(server.RootDataDir, location+".gz") &&
+				(!forward || !hashlikeExpression.MatchString(location))) {
+			missing = append(missing, location)
+		}
+	}
+	if len(missing) != 0 {
+		http.Error(w, "Not found: "+strings.Join(missing, ", "), 404)
+		return
+	}
+
+	filename := req.Form.Get("filename")
+	if filename == "" {
+		filename = "bundle." + format
+	}
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", sanitizeFilename(filename)))
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+	}
+	w.WriteHeader(http.StatusOK)
+	if req.Method == "HEAD" {
+		return
+	}
+
+	var archive bundleWriter
+	if format == "zip" {
+		archive = &zipBundleWriter{zip.NewWriter(w)}
+	} else {
+		archive = &tarBundleWriter{tar.NewWriter(w)}
+	}
+
+	for index, location := range locations {
+		name := strings.TrimPrefix(location, "/")
+		if len(names) != 0 && path.Clean("/"+names[index]) != "/" {
+			// only allow relative names, so that the archive can be safely extracted
+			name = strings.TrimPrefix(path.Clean("/"+names[index]), "/")
+		}
+
+		err = server.addToBundle(archive, location, name, format == "tar")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error bundling %s: %s\n", location, err.Error())
+			// we've already sent the response code, so abort the response rather than finishing it
+			// normally; otherwise the client would think it had the whole archive
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (server vermServer) addToBundle(archive bundleWriter, location, name string, needSize bool) error {
+	member, err := server.openBundleMember(location, needSize)
+	if err != nil {
+		return err
+	}
+	defer member.Close()
+
+	member.name = name
+	return archive.add(member)
+}
+
+// openBundleMember opens the uncompressed contents of the given file, from our own copy if we have
+// one or otherwise from the replicas.  tar archives need to know the size of each file before its
+// contents, so if needSize is set, files that we can't tell the size of are read into temporary
+// files first.
+func (server vermServer) openBundleMember(location string, needSize bool) (*bundleMember, error) {
+	member := &bundleMember{compress: compressibleType(mimeext.TypeByExtension(filepath.Ext(location)))}
+
+	err := server.openLocalBundleMember(member, location, needSize)
+	if os.IsNotExist(err) {
+		err = server.openReplicaBundleMember(member, location)
+	}
+	if err != nil {
+		member.Close()
+		return nil, err
+	}
+
+	if needSize && member.size < 0 {
+		spooled, err := ioutil.TempFile("", "verm-bundle")
+		if err == nil {
+			os.Remove(spooled.Name()) // we only need it while it's open
+			member.closers = append(member.closers, spooled)
+			member.size, err = io.Copy(spooled, member.content)
+		}
+		if err == nil {
+			_, err = spooled.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			member.Close()
+			return nil, err
+		}
+		member.content = spooled
+	}
+	return member, nil
+}
+
+func (server vermServer) openLocalBundleMember(member *bundleMember, location string, needSize bool) error {
+	file, stat, err := server.openFile(location)
+	if err == nil {
+		member.closers = append(member.closers, file)
+		member.content, member.size, member.modTime = file, stat.Size(), stat.ModTime()
+		return nil
+	}
+
+	file, stat, err = server.openFile(location + ".gz")
+	if err != nil {
+		if _, ok := err.(*IsDirectoryError); ok {
+			return err
+		}
+		return os.ErrNotExist
+	}
+	member.closers = append(member.closers, file)
+	member.modTime = stat.ModTime()
+	member.size = -1
+
+	if needSize {
+		// this will usually be quick, and if not, the index will make it quick next time
+		index, err := server.GzipIndexer.index(location, server.RootDataDir+location+".gz", stat.Size(), true)
+		if err != nil {
+			return err
+		}
+		member.size = index.Size
+		index.Close()
+	}
+
+	uncompressed, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	member.closers = append(member.closers, uncompressed)
+	member.content = uncompressed
+	return nil
+}
+
+func (server vermServer) openReplicaBundleMember(member *bundleMember, location string) error {
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	ch := make(chan *http.Response)
+	go server.Targets.forwardRequest(nil, req, ch)
+	resp := <-ch
+	if resp == nil {
+		return fmt.Errorf("%s isn't here or on any replica", location)
+	}
+	member.closers = append(member.closers, resp.Body)
+	member.content, member.size = resp.Body, resp.ContentLength
+	member.modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		uncompressed, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		member.closers = append(member.closers, uncompressed)
+		member.content, member.size = uncompressed, -1
+	}
+	return nil
+}
+
+type zipBundleWriter struct {
+	writer *zip.Writer
+}
+
+func (archive *zipBundleWriter) add(member *bundleMember) error {
+	header := &zip.FileHeader{
+		Name:     member.name,
+		Method:   zip.Store,
+		Modified: member.modTime,
+	}
+	if member.compress {
+		header.Method = zip.Deflate
+	}
+	header.SetMode(BundleFileMode)
+
+	output, err := archive.writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(output, member.content)
+	return err
+}
+
+func (archive *zipBundleWriter) Close() error {
+	return archive.writer.Close()
+}
+
+type tarBundleWriter struct {
+	writer *tar.Writer
+}
+
+func (archive *tarBundleWriter) add(member *bundleMember) error {
+	err := archive.writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     member.name,
+		Size:     member.size,
+		Mode:     BundleFileMode,
+		ModTime:  member.modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(archive.writer, member.content, member.size)
+	return err
+}
+
+func (archive *tarBundleWriter) Close() error {
+	return archive.writer.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "path"
+import "strings"
+
+// verm's filenames are hashes, which aren't much use to people saving files, so clients can give
+// a filename parameter to name the download, or download=1 to download the file under the name it
+// was uploaded with (if we remember it) rather than displaying it.
+
+// setContentDisposition sets the Content-Disposition header requested by the client's filename
+// and download parameters, if any, using the given filename if the client doesn't give one.
+func setContentDisposition(w http.ResponseWriter, req *http.Request, defaultFilename string) {
+	query := req.URL.Query()
+	filename := sanitizeFilename(query.Get("filename"))
+	download := query.Get("download")
+
+	disposition := "inline"
+	if download == "1" || (filename != "" && download != "0") {
+		disposition = "attachment"
+	}
+	if filename == "" {
+		filename = defaultFilename
+	}
+
+	if filename != "" || disposition == "attachment" {
+		w.Header().Set("Content-Disposition", contentDisposition(disposition, filename))
+	}
+}
+
+// contentDisposition formats a Content-Disposition header value as described in RFC 6266.
+// filenames that aren't plain ASCII are given using the RFC 5987 filename* parameter, with an
+// ASCII approximation in the filename parameter for clients that don't support it.
+func contentDisposition(disposition, filename string) string {
+	if filename == "" {
+		return disposition
+	}
+
+	fallback := make([]byte, 0, len(filename))
+	plain := true
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' || r == '%' {
+			// some clients percent-decode the filename parameter, so % needs the encoded form too
+			fallback = append(fallback, '_')
+			plain = false
+		} else {
+			fallback = append(fallback, byte(r))
+		}
+	}
+	if plain {
+		return disposition + `; filename="` + filename + `"`
+	}
+
+	var encoded strings.Builder
+	for _, b := range []byte(filename) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			encoded.WriteByte('%')
+			encoded.WriteByte("0123456789ABCDEF"[b>>4])
+			encoded.WriteByte("0123456789ABCDEF"[b&15])
+		}
+	}
+	return disposition + `; filename="` + string(fallback) + `"; filename*=UTF-8''` + encoded.String()
+}
+
+// isAttrChar returns true if the given byte may appear unencoded in an RFC 5987 value.
+func isAttrChar(b byte) bool {
+	return (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+		strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// sanitizeFilename strips any directory path from a filename, as browsers send the full path of
+// uploaded files on some platforms, and removes control characters.
+func sanitizeFilename(filename string) string {
+	filename = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, filename)
+	filename = path.Base(strings.Replace(filename, "\\", "/", -1))
+	if filename == "." || filename == "/" || filename == ".." {
+		return ""
+	}
+	return filename
+}
+
+// rememberFilename records the name that the file at the given location was uploaded with, so that
+// it can be used to name downloads.  files are stored by their contents, so the same file may be
+// uploaded under different names; we keep the first.
+func (server vermServer) rememberFilename(location, filename string) {
+	filename = sanitizeFilename(filename)
+	if filename == "" {
+		return
+	}
+
+	rememberedFilename := server.StateDir + FilenamesSubdirectory + location
+	if _, err := os.Stat(rememberedFilename); err == nil {
+		return
+	}
+	if err := writeFileAtomically(rememberedFilename, []byte(filename)); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't remember filename for %s: %s\n", location, err.Error())
+	}
+}
+
+// rememberedFilename returns the name that the file at the given location was uploaded with, or
+// an empty string if we don't know it.
+func (server vermServer) rememberedFilename(location string) string {
+	data, err := ioutil.ReadFile(server.StateDir + FilenamesSubdirectory + location)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -1,7 +1,9 @@
 package main
 
+import "bufio"
 import "compress/gzip"
 import "io"
+import "strings"
 
 func EncodingDecoder(encoding string, input io.Reader) (io.Reader, error) {
 	switch encoding {
@@ -33,3 +35,47 @@ type EncodingError struct {
 func (e *EncodingError) Error() string {
 	return "Don't know how to decode " + e.encoding
 }
+
+// compressibleType returns true if files of the given content type are generally worth
+// compressing.  most other types, such as images, video and archives, are compressed already.
+func compressibleType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if index := strings.Index(contentType, ";"); index >= 0 {
+		contentType = strings.TrimSpace(contentType[:index])
+	}
+	if strings.HasPrefix(contentType, "text/") ||
+		strings.HasSuffix(contentType, "+xml") ||
+		strings.HasSuffix(contentType, "+json") {
+		return true
+	}
+	switch contentType {
+	case "application/json", "application/xml", "application/javascript", "application/x-javascript",
+		"application/ecmascript", "application/csv", "application/x-ndjson", "application/x-yaml",
+		"application/yaml", "application/sql", "application/x-sh", "application/postscript",
+		"application/rtf", "application/x-tar", "application/wasm", "image/bmp", "image/x-icon",
+		"image/vnd.microsoft.icon", "font/ttf", "font/otf", "application/x-font-ttf":
+		return true
+	}
+	return false
+}
+
+// compressForTransfer returns a stream of the gzip-compressed contents of the input.
+func compressForTransfer(input io.Reader) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		// the compressor makes lots of small writes, which would otherwise each be sent as a chunk
+		buffered := bufio.NewWriterSize(writer, 32*1024)
+		compressor := gzip.NewWriter(buffered)
+		_, err := io.Copy(compressor, input)
+		if err == nil {
+			err = compressor.Close()
+		}
+		if err == nil {
+			err = buffered.Flush()
+		}
+		// the reader gets EOF if err is nil; if the reader has been closed, io.Copy will have
+		// failed, so we don't hang around
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
@@ -0,0 +1,212 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "fmt"
+import "os"
+import "strings"
+import "syscall"
+import "time"
+import "unsafe"
+
+// Verm's layout is compatible with a plain filesystem, so files are sometimes restored by copying
+// them straight into the data directory, but we wouldn't otherwise notice them until the next
+// resync.  the data watcher uses inotify to notice files being written or moved into the data
+// directory, checks that they are stored under the right location for their contents, and
+// queues them for replication.
+//
+// our own uploads are hardlinked into place from their _upload temporary files, which doesn't
+// produce the close or move events we look for, so we don't see those, but they may create new
+// directories, and we have to check the files in new directories in case they were written before
+// we started watching; we skip those that we've recently queued for replication ourselves.
+
+const dataWatcherMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE
+
+type dataWatcher struct {
+	fd                int
+	rootDataDirectory string
+	stateDirectory    string
+	targets           *ReplicationTargets
+	quiet             bool
+	directories       map[int32]string // watch descriptor to directory, relative to the root
+	candidates        chan dataWatcherCandidate
+}
+
+type dataWatcherCandidate struct {
+	location string
+	scanned  bool // found by scanning a new directory rather than from an event
+}
+
+func WatchDataDirectory(rootDataDirectory, stateDirectory string, targets *ReplicationTargets, quiet bool) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+
+	watcher := &dataWatcher{
+		fd:                fd,
+		rootDataDirectory: rootDataDirectory,
+		stateDirectory:    stateDirectory,
+		targets:           targets,
+		quiet:             quiet,
+		directories:       make(map[int32]string),
+		candidates:        make(chan dataWatcherCandidate, DataWatcherQueueSize),
+	}
+	targets.recentlyQueued = newRecentLocations(DataWatcherRecentFileTime * time.Second)
+
+	// files already present will be found by the resync at startup, so we don't need to look at
+	// them, just watch the directories
+	err = watcher.watchTree("", false)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	go watcher.readEvents()
+	go watcher.checkCandidates()
+	return nil
+}
+
+func (watcher *dataWatcher) ignored(path string) bool {
+	filename := watcher.rootDataDirectory + path
+	return filename == watcher.stateDirectory || strings.HasPrefix(filename, watcher.stateDirectory+"/")
+}
+
+// watchTree adds watches for the given directory and its subdirectories.  if scan is true, the
+// files already in them are also checked, since they may have been added before we were watching.
+func (watcher *dataWatcher) watchTree(directory string, scan bool) error {
+	wd, err := syscall.InotifyAddWatch(watcher.fd, watcher.rootDataDirectory+directory, dataWatcherMask)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch "+watcher.rootDataDirectory+directory, err)
+	}
+	watcher.directories[int32(wd)] = directory
+
+	dir, err := os.Open(watcher.rootDataDirectory + directory)
+	if err != nil {
+		return err
+	}
+	list, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, fileinfo := range list {
+		if strings.HasPrefix(fileinfo.Name(), "_upload") {
+			continue
+		}
+		expanded := directory + "/" + fileinfo.Name()
+		if watcher.ignored(expanded) {
+			continue
+		}
+		if fileinfo.IsDir() {
+			err = watcher.watchTree(expanded, scan)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't watch %s: %s\n", expanded, err.Error())
+			}
+		} else if scan && fileinfo.Mode().IsRegular() {
+			watcher.enqueueCandidate(expanded, true)
+		}
+	}
+	return nil
+}
+
+func (watcher *dataWatcher) readEvents() {
+	var buf [64 * 1024]byte
+	for {
+		n, err := syscall.Read(watcher.fd, buf[:])
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading data directory events, no longer watching: %s\n", err.Error())
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := strings.TrimRight(string(buf[offset+syscall.SizeofInotifyEvent:offset+syscall.SizeofInotifyEvent+int(event.Len)]), "\x00")
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			watcher.handleEvent(event.Wd, event.Mask, name)
+		}
+	}
+}
+
+func (watcher *dataWatcher) handleEvent(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		fmt.Fprintf(os.Stderr, "Too many changes to the data directory to keep track of, resyncing\n")
+		watcher.targets.EnqueueResync()
+		return
+	}
+
+	directory, ok := watcher.directories[wd]
+	if !ok {
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		// the directory has been removed
+		delete(watcher.directories, wd)
+		return
+	}
+	if name == "" || strings.HasPrefix(name, "_upload") {
+		return
+	}
+	expanded := directory + "/" + name
+	if watcher.ignored(expanded) {
+		return
+	}
+
+	if mask&syscall.IN_ISDIR != 0 {
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			err := watcher.watchTree(expanded, true)
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Couldn't watch %s: %s\n", expanded, err.Error())
+			}
+		}
+	} else if mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0 {
+		watcher.enqueueCandidate(expanded, false)
+	}
+}
+
+func (watcher *dataWatcher) enqueueCandidate(path string, scanned bool) {
+	select {
+	case watcher.candidates <- dataWatcherCandidate{location: strings.TrimSuffix(path, ".gz"), scanned: scanned}:
+
+	default:
+		// we can't keep up checking files, so fall back to a resync, which will find them all
+		watcher.targets.EnqueueResync()
+	}
+}
+
+// checkCandidates checks the files we've seen added in a separate goroutine to the one reading
+// events, since hashing large files takes a while and we don't want the event queue to overflow.
+func (watcher *dataWatcher) checkCandidates() {
+	for candidate := range watcher.candidates {
+		if candidate.scanned && watcher.targets.recentlyQueued.contains(candidate.location) {
+			continue
+		}
+
+		err := verifyStoredFile(watcher.rootDataDirectory, candidate.location)
+		_, wrongLocation := err.(*WrongLocationError)
+
+		switch {
+		case err == nil:
+			if !watcher.quiet {
+				fmt.Fprintf(os.Stdout, "Found %s added to the data directory, replicating\n", candidate.location)
+			}
+			// the file may well have come from a backup of another server, so check it's missing
+			// before sending it
+			watcher.targets.EnqueueFile(candidate.location, true)
+
+		case os.IsNotExist(err):
+			// removed again already
+
+		case wrongLocation && candidate.scanned:
+			// a file found when scanning a new directory may not have been completely written
+			// yet; if not, we'll get an event when it has been
+
+		default:
+			fmt.Fprintf(os.Stderr, "Ignoring %s added to the data directory: %s\n", candidate.location, err.Error())
+		}
+	}
+}
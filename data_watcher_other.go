@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// the data watcher uses inotify, so isn't available on other platforms; see data_watcher_linux.go.
+func WatchDataDirectory(rootDataDirectory, stateDirectory string, targets *ReplicationTargets, quiet bool) error {
+	return fmt.Errorf("watching the data directory is only supported on Linux")
+}
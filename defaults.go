@@ -1,6 +1,7 @@
 package main
 
 const DefaultRoot = "/var/lib/verm"
+const DefaultStateSubdirectory = "/_verm" // under the root data directory, unless the state option is given
 const DirectoryPermission = 0777
 
 const DefaultListenAddress = "0.0.0.0"
@@ -19,7 +20,73 @@ const ReplicationRequestTimeout = 3600 // want this to be large enough for a ver
 const ReplicationMissingFilesPath = "/_missing"
 const ReplicationMissingFilesBatchSize = 256*1024 // bytes, but only approximate
 const ReplicationMissingFilesBatchTime = 1 // seconds before we send even a small batch
+const ReplicationDeadLettersSubdirectory = "/dead_letters"
+const ReplicationPartialUploadPath = "/_partial"
+const ReplicationPartialUploadExpiry = 7 * 24 * 60 * 60  // seconds before we give up on the sender resuming
+const ReplicationResumableMinimumSize = 64 * 1024 * 1024 // bytes; smaller files are simply resent from the start
+const ReplicationBatchPath = "/_batch"
+const ReplicationBatchFileSizeLimit = 64 * 1024 // bytes; larger files are always sent by themselves
+const ReplicationBatchSize = 1024 * 1024        // bytes, but only approximate
+const ReplicationBatchMaxFiles = 1000
+const ReplicationBatchTime = 100                  // milliseconds to wait for more small files to send in the same batch
+const ReplicationLargeFileSize = 16 * 1024 * 1024 // bytes; larger files are only replicated by the large file lane's workers
+const ReplicationLargeQueueSize = 10000
+const ReplicationTransferEncodingHeader = "Verm-Transfer-Encoding"
+const ReplicationCompressMinimumSize = 1024 // bytes; smaller files aren't worth compressing on the wire
+const DefaultReplicationMissingShare = 25   // percent of workers
+const DefaultReplicationLargeShare = 10     // percent of workers
+const DefaultReplicationMinWorkers = 2
+const ReplicationConcurrencyInterval = 1        // seconds between adjustments to the number of active workers
+const ReplicationConcurrencyLatencyFactor = 2   // times the baseline latency at which we consider the target congested
+const ReplicationConcurrencyBaselineWeight = 32 // smoothing factor for the baseline latency as it rises
+const ReplicationIdleConnectionTimeout = 90     // seconds
+const ResyncScheduleJitter = 10                 // percent of the resync interval to randomly vary each scheduled resync by
+const ResyncSubtreeQueueSize = 100
+const DataWatcherQueueSize = 10000   // files waiting to be checked before we give up and resync instead
+const DataWatcherRecentFileTime = 60 // seconds to remember the files we've stored ourselves, so the data watcher doesn't check them again
+const ReplicationPullQueueSize = 10000
+const ReplicationPullWorkers = 2
+
+const AdminPathPrefix = "/_admin/"
+const AdminDeadLettersPath = AdminPathPrefix + "dead_letters"
+const AdminResyncPath = AdminPathPrefix + "resync"
+const AdminReplicatePath = AdminPathPrefix + "replicate"
+const AdminPausePath = AdminPathPrefix + "pause"
+const AdminResumePath = AdminPathPrefix + "resume"
+const AdminQueuePath = AdminPathPrefix + "queue"
+const AdminListPath = AdminPathPrefix + "list"
+const AdminQueueSampleSize = 100 // pending locations listed per queue unless the limit parameter is given
+
+const GzipIndexSubdirectory = "/gzip_index"
+const GzipIndexMinimumSize = 4 * 1024 * 1024        // compressed bytes; smaller files are quick enough to decompress in full
+const GzipIndexCheckpointInterval = 4 * 1024 * 1024 // uncompressed bytes between the points we can start decompressing from
+const GzipIndexQueueSize = 100
+
+const RenditionSubdirectory = "/renditions"
+const RenditionMaxSize = 4096                     // pixels wide or high
+const RenditionMaxSourcePixels = 50 * 1000 * 1000 // larger images use too much memory to resize
+const RenditionConcurrency = 2                    // renditions being made at once
+const RenditionJPEGQuality = 85
+
+const FilenamesSubdirectory = "/filenames"
+
+const QuarantineSubdirectory = "/quarantine"
+const ScrubProgressFilename = "/scrub.json"
+const DefaultScrubRate = 10 * 1024 * 1024 // bytes per second
+const ScrubReadSize = 64 * 1024           // bytes read between pauses
+const ScrubProgressSaveInterval = 60      // seconds
+const ScrubRetryDelay = 60                // seconds to wait after an error listing files before carrying on
+
+const ArchiveMemberSeparator = "/!/"
+
+const BundlePath = "/_bundle"
+const BundleMaxFiles = 10000
+const BundleFileMode = 0644
 
 const ReplicaProxyTimeout = 15
+const ReplicaFailureThreshold = 3 // consecutive failed forwarded reads before we stop forwarding to a replica
+const ReplicaProbeInterval = 30   // seconds between probes of a replica marked down
+const ReplicaHedgeDelay = 100     // milliseconds to wait for the nearest replica before also asking the next
+const ReplicaLatencyWeight = 8    // smoothing factor for the moving average of replica response times
 
 const ShutdownResponseTimeout = 15
@@ -0,0 +1,442 @@
+package main
+
+import "bufio"
+import "bytes"
+import "errors"
+import "io"
+
+// Go's flate package can only decompress a deflate stream from the start, so to be able to start
+// decompressing part-way through a large gzip file, we need to know where its deflate blocks
+// start.  scanDeflateBlocks decodes just enough of a deflate stream to find that out and to count
+// the uncompressed bytes; the decompression itself is still done by the flate package.
+
+var errCorruptDeflate = errors.New("corrupt deflate stream")
+
+// deflateBitReader reads a deflate stream's bits, least significant bit first.
+type deflateBitReader struct {
+	input    *bufio.Reader
+	bits     uint64
+	count    uint  // number of bits in bits
+	consumed int64 // number of bytes read from the input
+	err      error
+}
+
+// fill tries to make sure that there are at least n bits available, but may leave fewer if the
+// input ends first; the error is kept in err.
+func (reader *deflateBitReader) fill(n uint) {
+	for reader.count < n && reader.err == nil {
+		b, err := reader.input.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			reader.err = err
+			return
+		}
+		reader.bits |= uint64(b) << reader.count
+		reader.count += 8
+		reader.consumed++
+	}
+}
+
+func (reader *deflateBitReader) take(n uint) (uint32, error) {
+	reader.fill(n)
+	if reader.count < n {
+		return 0, reader.err
+	}
+	value := uint32(reader.bits & (1<<n - 1))
+	reader.bits >>= n
+	reader.count -= n
+	return value, nil
+}
+
+// offset returns the position of the next unread bit, counted from the start of the input.
+func (reader *deflateBitReader) offset() int64 {
+	return reader.consumed*8 - int64(reader.count)
+}
+
+func (reader *deflateBitReader) alignToByte() {
+	reader.bits >>= reader.count % 8
+	reader.count -= reader.count % 8
+}
+
+// skipBytes skips the given number of bytes, which must only be called when aligned to a byte.
+func (reader *deflateBitReader) skipBytes(n int64) error {
+	for n > 0 && reader.count > 0 {
+		reader.bits >>= 8
+		reader.count -= 8
+		n--
+	}
+	discarded, err := reader.input.Discard(int(n))
+	reader.consumed += int64(discarded)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// huffmanTable decodes a canonical Huffman code by looking up the next maxLength bits, giving the
+// symbol shifted left by 4 bits plus the length of its code, or 0 for invalid codes.
+type huffmanTable struct {
+	maxLength uint
+	entries   []uint32
+}
+
+func newHuffmanTable(lengths []uint8) (*huffmanTable, error) {
+	var counts [16]int
+	maxLength := uint(0)
+	for _, length := range lengths {
+		counts[length]++
+		if uint(length) > maxLength {
+			maxLength = uint(length)
+		}
+	}
+	counts[0] = 0
+
+	var next [16]int
+	code := 0
+	for length := 1; length < 16; length++ {
+		code = (code + counts[length-1]) << 1
+		next[length] = code
+	}
+
+	table := &huffmanTable{maxLength: maxLength, entries: make([]uint32, 1<<maxLength)}
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		code := next[length]
+		next[length]++
+		if code >= 1<<length {
+			// over-subscribed
+			return nil, errCorruptDeflate
+		}
+
+		// the codes are packed starting with their most significant bit, so reverse them to
+		// match the order we read bits in
+		reversed := 0
+		for bit := uint8(0); bit < length; bit++ {
+			reversed = reversed<<1 | (code>>bit)&1
+		}
+		for index := reversed; index < len(table.entries); index += 1 << length {
+			table.entries[index] = uint32(symbol)<<4 | uint32(length)
+		}
+	}
+	return table, nil
+}
+
+func (reader *deflateBitReader) decode(table *huffmanTable) (int, error) {
+	reader.fill(table.maxLength)
+	entry := table.entries[reader.bits&(1<<table.maxLength-1)]
+	length := uint(entry & 15)
+	if length == 0 {
+		return 0, errCorruptDeflate
+	} else if length > reader.count {
+		return 0, reader.err
+	}
+	reader.bits >>= length
+	reader.count -= length
+	return int(entry >> 4), nil
+}
+
+var deflateLengthBase = [29]int64{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+var deflateLengthExtra = [29]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+var deflateDistanceExtra = [30]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+var deflateCodeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+var fixedLiteralTable, fixedDistanceTable = fixedHuffmanTables()
+
+func fixedHuffmanTables() (*huffmanTable, *huffmanTable) {
+	var lengths [288]uint8
+	for symbol := range lengths {
+		switch {
+		case symbol < 144:
+			lengths[symbol] = 8
+		case symbol < 256:
+			lengths[symbol] = 9
+		case symbol < 280:
+			lengths[symbol] = 7
+		default:
+			lengths[symbol] = 8
+		}
+	}
+	literals, _ := newHuffmanTable(lengths[:])
+
+	var distanceLengths [30]uint8
+	for symbol := range distanceLengths {
+		distanceLengths[symbol] = 5
+	}
+	distances, _ := newHuffmanTable(distanceLengths[:])
+	return literals, distances
+}
+
+// scanDeflateBlocks reads a deflate stream up to the end of its final block, calling block with
+// the bit offset and the uncompressed offset of the start of each block.  it returns the total
+// uncompressed size.
+func scanDeflateBlocks(reader *deflateBitReader, block func(bitOffset, uncompressed int64) error) (int64, error) {
+	uncompressed := int64(0)
+	for {
+		err := block(reader.offset(), uncompressed)
+		if err != nil {
+			return 0, err
+		}
+
+		final, err := reader.take(1)
+		if err != nil {
+			return 0, err
+		}
+		blockType, err := reader.take(2)
+		if err != nil {
+			return 0, err
+		}
+
+		switch blockType {
+		case 0:
+			length, err := reader.storedBlock()
+			if err != nil {
+				return 0, err
+			}
+			uncompressed += length
+
+		case 1:
+			length, err := reader.huffmanBlock(fixedLiteralTable, fixedDistanceTable)
+			if err != nil {
+				return 0, err
+			}
+			uncompressed += length
+
+		case 2:
+			literals, distances, err := reader.dynamicTables()
+			if err != nil {
+				return 0, err
+			}
+			length, err := reader.huffmanBlock(literals, distances)
+			if err != nil {
+				return 0, err
+			}
+			uncompressed += length
+
+		default:
+			return 0, errCorruptDeflate
+		}
+
+		if final == 1 {
+			return uncompressed, nil
+		}
+	}
+}
+
+func (reader *deflateBitReader) storedBlock() (int64, error) {
+	reader.alignToByte()
+	length, err := reader.take(16)
+	if err != nil {
+		return 0, err
+	}
+	complement, err := reader.take(16)
+	if err != nil {
+		return 0, err
+	}
+	if length != ^complement&0xffff {
+		return 0, errCorruptDeflate
+	}
+	return int64(length), reader.skipBytes(int64(length))
+}
+
+func (reader *deflateBitReader) dynamicTables() (*huffmanTable, *huffmanTable, error) {
+	literalCount, err := reader.take(5)
+	if err != nil {
+		return nil, nil, err
+	}
+	distanceCount, err := reader.take(5)
+	if err != nil {
+		return nil, nil, err
+	}
+	codeLengthCount, err := reader.take(4)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var codeLengthLengths [19]uint8
+	for index := 0; index < int(codeLengthCount)+4; index++ {
+		length, err := reader.take(3)
+		if err != nil {
+			return nil, nil, err
+		}
+		codeLengthLengths[deflateCodeLengthOrder[index]] = uint8(length)
+	}
+	codeLengths, err := newHuffmanTable(codeLengthLengths[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lengths := make([]uint8, int(literalCount)+257+int(distanceCount)+1)
+	for index := 0; index < len(lengths); {
+		symbol, err := reader.decode(codeLengths)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var repeat uint32
+		value := uint8(0)
+		switch {
+		case symbol < 16:
+			lengths[index] = uint8(symbol)
+			index++
+			continue
+		case symbol == 16:
+			if index == 0 {
+				return nil, nil, errCorruptDeflate
+			}
+			value = lengths[index-1]
+			repeat, err = reader.take(2)
+			repeat += 3
+		case symbol == 17:
+			repeat, err = reader.take(3)
+			repeat += 3
+		default:
+			repeat, err = reader.take(7)
+			repeat += 11
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if index+int(repeat) > len(lengths) {
+			return nil, nil, errCorruptDeflate
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[index] = value
+			index++
+		}
+	}
+
+	literals, err := newHuffmanTable(lengths[:literalCount+257])
+	if err != nil {
+		return nil, nil, err
+	}
+	distances, err := newHuffmanTable(lengths[literalCount+257:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return literals, distances, nil
+}
+
+func (reader *deflateBitReader) huffmanBlock(literals, distances *huffmanTable) (int64, error) {
+	uncompressed := int64(0)
+	for {
+		symbol, err := reader.decode(literals)
+		if err != nil {
+			return 0, err
+		}
+
+		if symbol < 256 {
+			uncompressed++
+			continue
+		} else if symbol == 256 {
+			return uncompressed, nil
+		}
+
+		symbol -= 257
+		if symbol >= len(deflateLengthBase) {
+			return 0, errCorruptDeflate
+		}
+		extra, err := reader.take(deflateLengthExtra[symbol])
+		if err != nil {
+			return 0, err
+		}
+		uncompressed += deflateLengthBase[symbol] + int64(extra)
+
+		if distances.maxLength == 0 {
+			return 0, errCorruptDeflate
+		}
+		distance, err := reader.decode(distances)
+		if err != nil {
+			return 0, err
+		}
+		if distance >= len(deflateDistanceExtra) {
+			return 0, errCorruptDeflate
+		}
+		_, err = reader.take(deflateDistanceExtra[distance])
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// the flate package can only start decompressing at a byte boundary, but deflate blocks needn't
+// start on one.  we can't just shift the rest of the stream along, because stored blocks are
+// aligned to byte boundaries in the original stream; instead we put empty blocks in front, taking
+// up enough bits to fill the part of the first byte before the block we want to start from.
+type deflateBitWriter struct {
+	bytes []byte
+	count uint
+}
+
+func (writer *deflateBitWriter) write(value uint32, n uint) {
+	for bit := uint(0); bit < n; bit++ {
+		if writer.count%8 == 0 {
+			writer.bytes = append(writer.bytes, 0)
+		}
+		writer.bytes[len(writer.bytes)-1] |= byte(value>>bit&1) << (writer.count % 8)
+		writer.count++
+	}
+}
+
+// emptyFixedBlock writes a block using the fixed codes which only has the end-of-block code, which
+// takes 10 bits.
+func (writer *deflateBitWriter) emptyFixedBlock() {
+	writer.write(0, 1) // not final
+	writer.write(1, 2) // fixed codes
+	writer.write(0, 7) // end of block
+}
+
+// emptyDynamicBlock writes a block with its own codes which only has the end-of-block code, which
+// takes 95 bits, so that we can make prefixes of odd lengths too.  the codes are complete so that
+// any decoder will accept them.
+func (writer *deflateBitWriter) emptyDynamicBlock() {
+	writer.write(0, 1)  // not final
+	writer.write(2, 2)  // dynamic codes
+	writer.write(0, 5)  // 257 literal/length codes
+	writer.write(1, 5)  // 2 distance codes
+	writer.write(15, 4) // 19 code length codes
+	for _, symbol := range deflateCodeLengthOrder {
+		if symbol == 1 || symbol == 18 {
+			writer.write(1, 3)
+		} else {
+			writer.write(0, 3)
+		}
+	}
+	writer.write(0, 1)      // literal 0 has length 1
+	writer.write(1, 1)      // followed by 138 zero lengths
+	writer.write(138-11, 7) //
+	writer.write(1, 1)      // and another 117 zero lengths
+	writer.write(117-11, 7) //
+	writer.write(0, 1)      // end of block has length 1
+	writer.write(0, 1)      // distance 0 has length 1
+	writer.write(0, 1)      // distance 1 has length 1
+	writer.write(1, 1)      // end of block
+}
+
+// deflateReaderAt returns a deflate stream starting with the block at the given bit offset in the
+// first byte of the given input, for passing to the flate package.
+func deflateReaderAt(input io.Reader, bits uint) (io.Reader, error) {
+	if bits == 0 {
+		return input, nil
+	}
+
+	writer := &deflateBitWriter{}
+	if bits%2 == 1 {
+		writer.emptyDynamicBlock()
+	}
+	for writer.count%8 != bits {
+		writer.emptyFixedBlock()
+	}
+
+	var first [1]byte
+	_, err := io.ReadFull(input, first[:])
+	if err != nil {
+		return nil, err
+	}
+	prefix := writer.bytes
+	prefix[len(prefix)-1] |= first[0] &^ (1<<bits - 1)
+	return io.MultiReader(bytes.NewReader(prefix), input), nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import "bufio"
+import "flag"
+import "fmt"
+import "net"
+import "net/http"
+import "net/url"
+import "os"
+import "path"
+import "strings"
+import "time"
+
+// verm diff compares the files stored on two servers, or on a server and in a local data
+// directory, by merging their listings, and prints the locations that are only on one side.  like
+// diff(1), it exits with status 0 if there are no differences, 1 if there are, and 2 if there
+// was trouble.
+
+// listing a big server can take a long time, so as for replication, we only limit the whole
+// request generously and otherwise rely on the network timeouts and TCP keepalives.
+var listClient = &http.Client{
+	Timeout: ReplicationRequestTimeout * time.Second,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   ReplicationNetworkTimeout * time.Second,
+			KeepAlive: ReplicationNetworkTimeout * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   ReplicationNetworkTimeout * time.Second,
+		ResponseHeaderTimeout: ReplicationNetworkTimeout * time.Second,
+	},
+}
+
+// diffSide produces the listing for one side of the comparison.
+type diffSide struct {
+	name      string
+	locations chan string
+	err       error // set before locations is closed
+}
+
+func diffCommand(args []string) int {
+	var directory, stateDirectory, adminToken string
+	var countsOnly bool
+
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s diff [options] <hostname[:port] or directory> <hostname[:port] or directory>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&directory, "directory", "", "Only compare files under this directory, eg. /foo.  Default: compare all files.")
+	flags.StringVar(&stateDirectory, "state", "", "The state directory used by the Verm server for any local data directories being compared, which isn't part of the file store.  Default: the _verm subdirectory of the data directory.")
+	flags.StringVar(&adminToken, "admin-token", "", "The admin token to give to the Verm servers being compared.  Listing files requires the admin API to be enabled.")
+	flags.BoolVar(&countsOnly, "counts-only", false, "Only print the number of files on each side, not the locations that differ.")
+	setFlagsFromEnvironment(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	directory = strings.TrimSuffix(path.Clean("/"+directory), "/")
+
+	sides := []*diffSide{}
+	for _, spec := range flags.Args() {
+		side := &diffSide{name: spec, locations: make(chan string, 1000)}
+		// hostnames can't contain slashes, so anything that does is a directory
+		if strings.Contains(spec, "/") || spec == "." || spec == ".." {
+			state := stateDirectory
+			if state == "" {
+				state = strings.TrimSuffix(spec, "/") + DefaultStateSubdirectory
+			}
+			go side.listDirectory(strings.TrimSuffix(spec, "/"), state, directory)
+		} else {
+			hostname, port := parseTarget(spec)
+			go side.listServer(hostname, port, adminToken, directory)
+		}
+		sides = append(sides, side)
+	}
+
+	onlyFirst, onlySecond, both := diffSides(sides[0], sides[1], func(prefix, location string) {
+		if !countsOnly {
+			fmt.Fprintf(os.Stdout, "%s %s\n", prefix, location)
+		}
+	})
+
+	trouble := false
+	for _, side := range sides {
+		if side.err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't list files on %s: %s\n", side.name, side.err.Error())
+			trouble = true
+		}
+	}
+	if trouble {
+		return 2
+	}
+
+	fmt.Fprintf(os.Stdout, "%d only on %s, %d only on %s, %d on both\n", onlyFirst, sides[0].name, onlySecond, sides[1].name, both)
+	if onlyFirst > 0 || onlySecond > 0 {
+		return 1
+	}
+	return 0
+}
+
+// diffSides merges the two listings, calling report with "<" for each location only on the first
+// side and ">" for each location only on the second side.
+func diffSides(first, second *diffSide, report func(prefix, location string)) (onlyFirst, onlySecond, both int) {
+	a, aok := <-first.locations
+	b, bok := <-second.locations
+	for aok || bok {
+		if !bok || (aok && compareLocations(a, b) < 0) {
+			report("<", a)
+			onlyFirst++
+			a, aok = <-first.locations
+		} else if !aok || compareLocations(a, b) > 0 {
+			report(">", b)
+			onlySecond++
+			b, bok = <-second.locations
+		} else {
+			both++
+			a, aok = <-first.locations
+			b, bok = <-second.locations
+		}
+	}
+	return
+}
+
+func (side *diffSide) listDirectory(root, stateDirectory, directory string) {
+	defer close(side.locations)
+	stat, err := os.Stat(root)
+	if err == nil && !stat.IsDir() {
+		err = fmt.Errorf("%s is not a directory", root)
+	}
+	if err != nil {
+		side.err = err
+		return
+	}
+
+	side.err = listLocations(root, directory, func(filename string) bool {
+		return root+filename == stateDirectory || strings.HasPrefix(root+filename, stateDirectory+"/")
+	}, func(location string) error {
+		side.locations <- location
+		return nil
+	})
+}
+
+func (side *diffSide) listServer(hostname, port, adminToken, directory string) {
+	defer close(side.locations)
+
+	address := fmt.Sprintf("http://%s:%s%s?directory=%s", hostname, port, AdminListPath, url.QueryEscape(directory))
+	req, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		side.err = err
+		return
+	}
+	req.Header.Add("Authorization", "Bearer "+adminToken)
+
+	// the transport transparently requests and decompresses gzip-encoded responses
+	resp, err := listClient.Do(req)
+	if err != nil {
+		side.err = err
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		side.err = fmt.Errorf("HTTP error %d %s", resp.StatusCode, strings.TrimSpace(body))
+		return
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Split(ScanWholeLines)
+	for scanner.Scan() {
+		side.locations <- scanner.Text()
+	}
+	side.err = scanner.Err()
+}
@@ -110,66 +110,200 @@ func serveContent(w http.ResponseWriter, r *http.Request, size int64, content io
 	}
 }
 
-// modtime is the modification time of the resource to be served, or IsZero().
-// return value is whether this request is now complete.
-func checkLastModified(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
-	if modtime.IsZero() {
-		return false
+// scanETag determines if a syntactically valid ETag is present at s. If so,
+// the ETag and remaining text after consuming ETag is returned. Otherwise,
+// it returns "", "".
+func scanETag(s string) (etag string, remain string) {
+	s = textproto.TrimString(s)
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
 	}
-
-	// The Date-Modified header truncates sub-second precision, so
-	// use mtime < t+1s instead of mtime <= t to check for unmodified.
-	if t, err := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since")); err == nil && modtime.Before(t.Add(1*time.Second)) {
-		return true
+	if len(s[start:]) < 2 || s[start] != '"' {
+		return "", ""
 	}
-	return false
+	// ETag is either W/"text" or "text".
+	// See RFC 9110 section 8.8.3.
+	for i := start + 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		// Character values allowed in ETags.
+		case c == 0x21 || c >= 0x23 && c <= 0x7E || c >= 0x80:
+		case c == '"':
+			return s[:i+1], s[i+1:]
+		default:
+			return "", ""
+		}
+	}
+	return "", ""
 }
 
-// checkETag implements If-None-Match and If-Range checks.
-// The ETag must have been previously set in the http.ResponseWriter's headers.
-//
-// The return value is the effective request "Range" header to use and
-// whether this request is now considered done.
-func checkETag(w http.ResponseWriter, r *http.Request, etag string) bool {
-	// Invalidate the range request if the entity doesn't match the one
-	// the client was expecting.
-	// "If-Range: version" means "ignore the Range: header unless version matches the
-	// current file."
-	// We only support ETag versions.
-	// The caller must have set the ETag on the response already.
-	if ir := r.Header.Get("If-Range"); ir != "" && ir != etag {
-		// TODO(bradfitz): handle If-Range requests with Last-Modified
-		// times instead of ETags? I'd rather not, at least for
-		// now. That seems like a bug/compromise in the RFC 2616, and
-		// I've never heard of anybody caring about that (yet).
-		w.Header().Del("Range")
-	}
+// etagStrongMatch reports whether a and b match using strong ETag comparison.
+// Assumes a and b are valid ETags.
+func etagStrongMatch(a, b string) bool {
+	return a == b && a != "" && a[0] == '"'
+}
+
+// etagWeakMatch reports whether a and b match using weak ETag comparison.
+// Assumes a and b are valid ETags.
+func etagWeakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// condResult is the result of an HTTP request precondition check.
+// See RFC 9110 section 13.
+type condResult int
+
+const (
+	condNone condResult = iota
+	condTrue
+	condFalse
+)
 
-	if inm := r.Header.Get("If-None-Match"); inm != "" {
-		// Must know ETag.
+// checkETagList checks a comma-separated list of ETags, as given in If-Match and If-None-Match,
+// against the ETag that has been set in the http.ResponseWriter's headers.
+func checkETagList(w http.ResponseWriter, list string, match func(a, b string) bool) condResult {
+	if list == "" {
+		return condNone
+	}
+	for {
+		list = textproto.TrimString(list)
+		if len(list) == 0 {
+			break
+		}
+		if list[0] == ',' {
+			list = list[1:]
+			continue
+		}
+		if list[0] == '*' {
+			return condTrue
+		}
+		etag, remain := scanETag(list)
 		if etag == "" {
-			return false
+			break
+		}
+		if match(etag, w.Header().Get("Etag")) {
+			return condTrue
 		}
+		list = remain
+	}
+	return condFalse
+}
+
+func checkIfMatch(w http.ResponseWriter, r *http.Request) condResult {
+	return checkETagList(w, strings.Join(r.Header.Values("If-Match"), ","), etagStrongMatch)
+}
+
+func checkIfNoneMatch(w http.ResponseWriter, r *http.Request) condResult {
+	switch checkETagList(w, strings.Join(r.Header.Values("If-None-Match"), ","), etagWeakMatch) {
+	case condTrue:
+		return condFalse
+	case condFalse:
+		return condTrue
+	default:
+		return condNone
+	}
+}
+
+// checkUnmodifiedSince compares modtime to the date in the given header, returning condTrue if
+// the resource hasn't been modified since then.
+func checkUnmodifiedSince(r *http.Request, header string, modtime time.Time) condResult {
+	value := r.Header.Get(header)
+	if value == "" || modtime.IsZero() {
+		return condNone
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return condNone
+	}
+
+	// The Last-Modified header truncates sub-second precision so
+	// the modtime needs to be truncated too.
+	if !modtime.Truncate(time.Second).After(t) {
+		return condTrue
+	}
+	return condFalse
+}
 
-		// TODO(bradfitz): non-GET/HEAD requests require more work:
-		// sending a different status code on matches, and
-		// also can't use weak cache validators (those with a "W/
-		// prefix).  But most users of ServeContent will be using
-		// it on GET or HEAD, so only support those for now.
-		if r.Method != "GET" && r.Method != "HEAD" {
-			return false
+func checkIfRange(w http.ResponseWriter, r *http.Request, modtime time.Time) condResult {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return condNone
+	}
+	etag, _ := scanETag(ir)
+	if etag != "" {
+		if etagStrongMatch(etag, w.Header().Get("Etag")) {
+			return condTrue
 		}
+		return condFalse
+	}
+	// The If-Range value is typically the ETag value, but it may also be
+	// the modtime date.  Dates only count as a match if they're exact.
+	if modtime.IsZero() {
+		return condFalse
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return condFalse
+	}
+	if t.Unix() == modtime.Unix() {
+		return condTrue
+	}
+	return condFalse
+}
 
-		// TODO(bradfitz): deal with comma-separated or multiple-valued
-		// list of If-None-match values.  For now just handle the common
-		// case of a single item.
-		if inm == etag || inm == "*" {
+// checkPreconditions evaluates the request preconditions in the order given by RFC 9110 section
+// 13.2.2, and reports whether the request is now complete because a precondition resulted in
+// sending StatusNotModified or StatusPreconditionFailed.  The ETag and Last-Modified headers must
+// have been set in the http.ResponseWriter's headers.  If an If-Range precondition fails, the
+// Range header is removed from the request so that the whole file is sent.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
+	ch := checkIfMatch(w, r)
+	if ch == condNone {
+		ch = checkUnmodifiedSince(r, "If-Unmodified-Since", modtime)
+	}
+	if ch == condFalse {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return true
+	}
+
+	switch checkIfNoneMatch(w, r) {
+	case condFalse:
+		if r.Method == "GET" || r.Method == "HEAD" {
+			writeNotModified(w)
+		} else {
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}
+		return true
+	case condNone:
+		if (r.Method == "GET" || r.Method == "HEAD") && checkUnmodifiedSince(r, "If-Modified-Since", modtime) == condTrue {
+			writeNotModified(w)
 			return true
 		}
 	}
+
+	if r.Header.Get("Range") != "" && checkIfRange(w, r, modtime) == condFalse {
+		r.Header.Del("Range")
+	}
 	return false
 }
 
+func writeNotModified(w http.ResponseWriter) {
+	// RFC 9110 section 15.4.5:
+	// a sender SHOULD NOT generate representation metadata other than the
+	// above listed fields unless said metadata exists for the purpose of
+	// guiding cache updates (e.g., Last-Modified might be useful if the
+	// response does not have an ETag field).
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	if h.Get("Etag") != "" {
+		h.Del("Last-Modified")
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
 // httpRange specifies the byte range to be sent to the client.
 type httpRange struct {
 	start, length int64
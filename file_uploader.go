@@ -21,11 +21,15 @@ type fileUpload struct {
 	path        string
 	location    string
 	contentType string
+	filename    string // as uploaded, for multipart uploads
 	extension   string
 	encoding    string
 	input       io.Reader
 	hasher      hash.Hash
 	tempFile    *os.File
+	partialName string
+
+	deferDirectorySync bool
 }
 
 func (server vermServer) UploadFile(w http.ResponseWriter, req *http.Request, replicating bool) (location string, newFile bool, err error) {
@@ -38,10 +42,16 @@ func (server vermServer) UploadFile(w http.ResponseWriter, req *http.Request, re
 	// read it in to the hasher
 	_, err = io.Copy(uploader.hasher, uploader.input)
 	if err != nil {
+		// if the sender can resume the upload, hang on to what we've received so far
+		uploader.KeepPartial()
 		return
 	}
 
-	return uploader.Finish(server.Targets)
+	location, newFile, err = uploader.Finish(server.Targets)
+	if err == nil && server.RememberFilenames && uploader.filename != "" {
+		server.rememberFilename(location, uploader.filename)
+	}
+	return
 }
 
 func (server vermServer) FileUploader(w http.ResponseWriter, req *http.Request, replicating bool) (*fileUpload, error) {
@@ -50,12 +60,12 @@ func (server vermServer) FileUploader(w http.ResponseWriter, req *http.Request,
 
 	location := ""
 	if replicating {
+		var err error
 		location = path
-		lastSlash := strings.LastIndex(path, "/")
-		if lastSlash < 4 {
-			return nil, &WrongLocationError{path}
+		path, err = locationDirectory(location)
+		if err != nil {
+			return nil, err
 		}
-		path = path[0 : lastSlash-3]
 	}
 
 	// don't allow uploads to the root directory itself, which would be unmanageable
@@ -64,14 +74,30 @@ func (server vermServer) FileUploader(w http.ResponseWriter, req *http.Request,
 	}
 
 	// make a tempfile in the requested (or default, as above) directory
-	directory := server.RootDataDir + path
-	err := os.MkdirAll(directory, DirectoryPermission)
+	directory, err := server.uploadDirectory(path)
 	if err != nil {
 		return nil, err
 	}
 
+	// replication of large files can be resumed if the connection drops: the sender tells us
+	// which part of the file it's sending, and we keep what we've received under a name derived
+	// from the location until it sends the rest
+	partialName := ""
+	resumeOffset := int64(0)
+	if replicating && req.Header.Get("Content-Range") != "" {
+		resumeOffset, err = parseUploadContentRange(req.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+		partialName = partialUploadName(server.RootDataDir, path, location)
+	}
+
 	var tempFile *os.File
-	tempFile, err = ioutil.TempFile(directory, "_upload")
+	if resumeOffset > 0 {
+		tempFile, err = claimPartialUpload(directory, partialName, location, resumeOffset)
+	} else {
+		tempFile, err = ioutil.TempFile(directory, "_upload")
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -79,8 +105,20 @@ func (server vermServer) FileUploader(w http.ResponseWriter, req *http.Request,
 	// if the upload is a raw post, the input stream is the request body
 	var input io.Reader = req.Body
 
+	// replication senders may compress files on the wire, which doesn't change how we store them;
+	// note that any Content-Range is still in terms of the file as stored
+	if transferEncoding := req.Header.Get(ReplicationTransferEncodingHeader); replicating && transferEncoding != "" {
+		input, err = EncodingDecoder(transferEncoding, input)
+		if err != nil {
+			tempFile.Close()
+			os.Remove(tempFile.Name())
+			return nil, err
+		}
+	}
+
 	// but if the upload is a browser form, the input stream needs multipart decoding
 	contentType := mediaTypeOrDefault(textproto.MIMEHeader(req.Header))
+	filename := ""
 	if contentType == "multipart/form-data" {
 		file, mpheader, mperr := req.FormFile(UploadedFieldFieldForMultipart)
 		if mperr != nil {
@@ -88,6 +126,7 @@ func (server vermServer) FileUploader(w http.ResponseWriter, req *http.Request,
 		}
 		input = file
 		contentType = mediaTypeOrDefault(mpheader.Header)
+		filename = mpheader.Filename
 	}
 
 	// determine the appropriate extension from the content type
@@ -106,6 +145,11 @@ func (server vermServer) FileUploader(w http.ResponseWriter, req *http.Request,
 	// as we read from the stream, copy it into the tempfile - potentially in encoded format (except for the above case)
 	input = io.TeeReader(input, tempFile)
 
+	// if we're resuming, the stream to decode and hash starts with what we received previously
+	if resumeOffset > 0 {
+		input = io.MultiReader(io.NewSectionReader(tempFile, 0, resumeOffset), input)
+	}
+
 	// but uncompress the stream before feeding it to the hasher
 	input, err = EncodingDecoder(storageEncoding, input)
 	if err != nil {
@@ -130,14 +174,38 @@ func (server vermServer) FileUploader(w http.ResponseWriter, req *http.Request,
 		path:        path,
 		location:    location,
 		contentType: contentType,
+		filename:    filename,
 		extension:   extension,
 		encoding:    storageEncoding,
 		input:       input,
 		hasher:      sha256.New(),
 		tempFile:    tempFile,
+		partialName: partialName,
 	}, nil
 }
 
+// locationDirectory returns the directory that the file at the given location was uploaded to,
+// ie. the location without the subdirectory and filename that we derived from the hash.
+func locationDirectory(location string) (string, error) {
+	lastSlash := strings.LastIndex(location, "/")
+	if lastSlash < 4 {
+		return "", &WrongLocationError{location}
+	}
+	return location[0 : lastSlash-3], nil
+}
+
+// uploadDirectory checks that files may be uploaded to the given directory, creates it if it
+// doesn't already exist, and returns its full path.
+func (server vermServer) uploadDirectory(path string) (string, error) {
+	// our own state files aren't part of the file store, even if they're under the root directory
+	if server.isStatePath(path) {
+		return "", &ReservedPathError{path}
+	}
+
+	directory := server.RootDataDir + path
+	return directory, os.MkdirAll(directory, DirectoryPermission)
+}
+
 func (upload *fileUpload) Close() {
 	if upload.tempFile != nil {
 		os.Remove(upload.tempFile.Name()) // ignore errors, the tempfile is moot at this point
@@ -146,6 +214,18 @@ func (upload *fileUpload) Close() {
 	}
 }
 
+// KeepPartial keeps the data received so far for a resumable upload so that the sender can
+// send the rest later, rather than removing it in Close.
+func (upload *fileUpload) KeepPartial() {
+	if upload.tempFile != nil && upload.partialName != "" {
+		upload.tempFile.Close()
+		if os.Rename(upload.tempFile.Name(), upload.partialName) != nil {
+			os.Remove(upload.tempFile.Name())
+		}
+		upload.tempFile = nil
+	}
+}
+
 func (upload *fileUpload) Finish(targets *ReplicationTargets) (location string, newFile bool, err error) {
 	// build the subdirectory and filename from the hash
 	dir, dst := upload.encodeHash()
@@ -228,28 +308,39 @@ func (upload *fileUpload) Finish(targets *ReplicationTargets) (location string,
 
 	upload.Close()
 
+	replicatedLocation := location
+	if upload.extension == ".gz" {
+		// for the sake of replication, we can treat it as a gzip-encoded binary file rather than a raw gzip file;
+		// this is how we will interpret the filename when we restart and resync, so it's better to always do this
+		replicatedLocation = location[:len(location)-len(upload.extension)]
+	}
+
+	// if an earlier attempt to replicate the file to us was interrupted, we don't need what we
+	// received from it any more, whichever way the file has now arrived
+	os.Remove(partialUploadName(upload.root, upload.path, replicatedLocation))
+
 	if newFile {
-		// try to fsync the directory too
-		dirnode, openerr := os.Open(upload.root + subpath)
-		if openerr == nil { // ignore if not allowed to open it
-			dirnode.Sync()
-			dirnode.Close()
+		// try to fsync the directory too, unless our caller is going to do that for a whole batch of files
+		if !upload.deferDirectorySync {
+			syncDirectory(upload.root + subpath)
 		}
 
 		// queue the file for replication
-		if upload.extension == ".gz" {
-			// for the sake of replication, we can treat it as a gzip-encoded binary file rather than a raw gzip file;
-			// this is how we will interpret the filename when we restart and resync, so it's better to always do this
-			targets.EnqueueFile(location[:len(location) - len(upload.extension)], upload.replicating)
-		} else {
-			targets.EnqueueFile(location, upload.replicating)
-		}
+		targets.EnqueueFile(replicatedLocation, upload.replicating)
 	}
 
 	err = nil
 	return
 }
 
+func syncDirectory(directory string) {
+	dirnode, err := os.Open(directory)
+	if err == nil { // ignore if not allowed to open it
+		dirnode.Sync()
+		dirnode.Close()
+	}
+}
+
 func (upload *fileUpload) encodeHash() (string, string) {
 	const encodingAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
 	md := upload.hasher.Sum(nil)
@@ -356,3 +447,20 @@ type WrongLocationError struct {
 func (e *WrongLocationError) Error() string {
 	return e.location + " is not the correct location, is the file corrupt?"
 }
+
+type ReservedPathError struct {
+	path string
+}
+
+func (e *ReservedPathError) Error() string {
+	return e.path + " is reserved for Verm's own use"
+}
+
+type UploadOffsetError struct {
+	location string
+	offset   int64
+}
+
+func (e *UploadOffsetError) Error() string {
+	return fmt.Sprintf("don't have the first %d bytes of %s to resume from", e.offset, e.location)
+}
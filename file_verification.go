@@ -0,0 +1,272 @@
+package main
+
+import "compress/flate"
+import "compress/gzip"
+import "crypto/sha256"
+import "fmt"
+import "hash"
+import "io"
+import "os"
+import "path/filepath"
+import "strings"
+
+// verifyStoredFile checks that the contents of the file stored for the given location match the
+// hash that the location was derived from, returning a WrongLocationError if they don't.  as for
+// uploads, the hash is of the decoded contents if the file is stored gzip-encoded.
+func verifyStoredFile(rootDataDirectory, location string) error {
+	file, encoding, err := openStoredFile(rootDataDirectory, location)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return verifyStoredContents(location, encoding, file)
+}
+
+// openStoredFile opens the file stored for the given location, returning the encoding it's stored
+// with.
+func openStoredFile(rootDataDirectory, location string) (*os.File, string, error) {
+	encoding := "gzip"
+	file, err := os.Open(rootDataDirectory + location + ".gz")
+	if os.IsNotExist(err) {
+		file, err = os.Open(rootDataDirectory + location)
+		encoding = ""
+	}
+	return file, encoding, err
+}
+
+func verifyStoredContents(location, encoding string, stored io.Reader) error {
+	input, err := EncodingDecoder(encoding, stored)
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, input)
+	if err != nil {
+		return err
+	}
+
+	if !locationMatchesHash(location, hasher) {
+		return &WrongLocationError{location}
+	}
+	return nil
+}
+
+// corruptContentsError returns true if the given error from verifyStoredFile shows that the
+// file's contents are corrupt, rather than that we couldn't read them.
+func corruptContentsError(err error) bool {
+	switch err.(type) {
+	case *WrongLocationError, flate.CorruptInputError:
+		return true
+	}
+	return err == gzip.ErrChecksum || err == gzip.ErrHeader || err == io.ErrUnexpectedEOF
+}
+
+// locationMatchesHash returns true if the given location is one that fileUpload.Finish could have
+// given to a file with the given hash.
+func locationMatchesHash(location string, hasher hash.Hash) bool {
+	path, err := locationDirectory(location)
+	if err != nil {
+		return false
+	}
+
+	upload := &fileUpload{hasher: hasher}
+	dir, dst := upload.encodeHash()
+	subpath := path + dir
+	return strings.HasPrefix(location, subpath+dst) &&
+		!strings.Contains(location[len(subpath)+len(dst):], "/")
+}
+
+const hashEncodingAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_" // as used by fileUpload.encodeHash
+
+// locationHash returns the encoded hash of the contents of the file at the given location, or "" if
+// it doesn't look like a location that fileUpload.Finish would have given a file.  files stored
+// with a suffix after a hash collision don't have the contents they're named after, so we don't
+// know their hash.
+func locationHash(location string) string {
+	const filenameLength = 41 // see fileUpload.encodeHash
+
+	lastSlash := strings.LastIndex(location, "/")
+	if lastSlash < 3 || location[lastSlash-3] != '/' {
+		return ""
+	}
+	dir := location[lastSlash-2 : lastSlash]
+	filename := location[lastSlash+1:]
+	if index := strings.Index(filename, "."); index >= 0 {
+		filename = filename[:index]
+	}
+	if len(filename) != filenameLength {
+		return ""
+	}
+
+	hash := dir + filename
+	for _, c := range hash {
+		if !strings.ContainsRune(hashEncodingAlphabet, c) {
+			return ""
+		}
+	}
+	return hash
+}
+
+// locationDigest returns the SHA-256 hash of the contents of the file at the given location,
+// recovered by reversing fileUpload.encodeHash, or nil if we don't know it.
+func locationDigest(location string) []byte {
+	hash := locationHash(location)
+	if hash == "" {
+		return nil
+	}
+
+	values := make([]byte, len(hash))
+	for index := range hash {
+		values[index] = byte(strings.IndexByte(hashEncodingAlphabet, hash[index]))
+	}
+	if values[0] >= 32 || values[2] >= 32 {
+		// encodeHash only uses 5 bits for these characters
+		return nil
+	}
+
+	digest := make([]byte, sha256.Size)
+	digest[0] = values[0]<<3 | values[1]>>3
+	digest[1] = (values[1]&0x07)<<5 | values[2]
+	for dst, src := 2, 3; dst < len(digest); dst, src = dst+3, src+4 {
+		digest[dst+0] = values[src+0]<<2 | values[src+1]>>4
+		digest[dst+1] = (values[src+1]&0x0f)<<4 | values[src+2]>>2
+		digest[dst+2] = (values[src+2]&0x03)<<6 | values[src+3]
+	}
+	return digest
+}
+
+// readVerifier passes through the contents of a stored file as they're read to be sent to a
+// client, hashing them as it goes, and checks that they match the location's hash before giving
+// out the last of them, so that a corrupt file is never sent in full.  if the file is stored
+// gzip-encoded, the hash is of the decoded contents as for uploads, so a goroutine decodes it.
+type readVerifier struct {
+	input    io.ReadSeeker
+	location string
+	size     int64
+	position int64
+	hasher   hash.Hash
+	encoded  *io.PipeWriter // nil if the file isn't stored gzip-encoded
+	decoded  chan error
+	stopped  bool // if the contents weren't read in order, so we can't check them
+	err      error
+}
+
+func newReadVerifier(input io.ReadSeeker, location string, size int64, storedCompressed bool) *readVerifier {
+	verifier := &readVerifier{
+		input:    input,
+		location: location,
+		size:     size,
+		hasher:   sha256.New(),
+	}
+
+	if storedCompressed {
+		reader, writer := io.Pipe()
+		verifier.encoded = writer
+		verifier.decoded = make(chan error, 1)
+		go func() {
+			decoder, err := gzip.NewReader(reader)
+			if err == nil {
+				_, err = io.Copy(verifier.hasher, decoder)
+			}
+			// make further writes fail rather than block if we stopped early
+			reader.CloseWithError(err)
+			verifier.decoded <- err
+		}()
+	}
+	return verifier
+}
+
+func (verifier *readVerifier) Read(p []byte) (int, error) {
+	if verifier.err != nil {
+		return 0, verifier.err
+	}
+
+	n, err := verifier.input.Read(p)
+	if verifier.stopped {
+		return n, err
+	}
+
+	if verifier.encoded != nil {
+		// if the decoder fails, the file is corrupt, which we'll find out at the end
+		verifier.encoded.Write(p[:n])
+	} else {
+		verifier.hasher.Write(p[:n])
+	}
+	verifier.position += int64(n)
+
+	if verifier.position >= verifier.size || err == io.EOF {
+		verifier.stopped = true
+		if !verifier.verify() {
+			verifier.err = &WrongLocationError{verifier.location}
+			return 0, verifier.err
+		}
+	}
+	return n, err
+}
+
+func (verifier *readVerifier) verify() bool {
+	if verifier.encoded != nil {
+		verifier.encoded.Close()
+		if <-verifier.decoded != nil {
+			return false
+		}
+	}
+	return locationMatchesHash(verifier.location, verifier.hasher)
+}
+
+// Seek is only needed for serving byte ranges, which we don't verify.  seeking to where we are
+// already is harmless, though.
+func (verifier *readVerifier) Seek(offset int64, whence int) (int64, error) {
+	position, err := verifier.input.Seek(offset, whence)
+	if position != verifier.position {
+		verifier.Close()
+	}
+	return position, err
+}
+
+// Corrupt returns true if the file was read to the end and didn't match its hash.
+func (verifier *readVerifier) Corrupt() bool {
+	_, corrupt := verifier.err.(*WrongLocationError)
+	return corrupt
+}
+
+func (verifier *readVerifier) Close() {
+	if !verifier.stopped {
+		verifier.stopped = true
+		if verifier.encoded != nil {
+			verifier.encoded.CloseWithError(io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+// quarantineFile moves a file found to be corrupt out of the data directory and into the
+// quarantine subdirectory of the state directory, so that it can be examined later, and fetches
+// a good copy from the replicas.  until then, requests for it are forwarded to the replicas.
+func (server vermServer) quarantineFile(location string, storedCompressed bool) {
+	filename := location + EncodingSuffix("")
+	if storedCompressed {
+		filename = location + EncodingSuffix("gzip")
+	}
+	destination := server.StateDir + QuarantineSubdirectory + filename
+
+	fmt.Fprintf(os.Stderr, "Corrupt file %s doesn't match its hash, quarantining it as %s\n", filename, destination)
+	server.Statistics.CorruptFilesQuarantined.Add(1)
+
+	err := os.MkdirAll(filepath.Dir(destination), DirectoryPermission)
+	if err == nil {
+		err = os.Rename(server.RootDataDir+filename, destination)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Couldn't quarantine %s: %s\n", filename, err.Error())
+	}
+
+	// any gzip index or renditions were made from the corrupt file, so aren't valid for a good copy
+	os.Remove(server.GzipIndexer.indexFilename(location))
+	if server.Renditions != nil {
+		os.RemoveAll(server.Renditions.directory + location)
+	}
+
+	server.Targets.EnqueuePull(location)
+}
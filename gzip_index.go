@@ -0,0 +1,490 @@
+package main
+
+import "bufio"
+import "bytes"
+import "compress/flate"
+import "compress/gzip"
+import "encoding/binary"
+import "encoding/gob"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "sort"
+import "sync"
+
+// serving byte ranges of a file stored gzip-encoded to a client that doesn't accept gzip needs the
+// uncompressed size, and a way to start decompressing part-way through the file.  for large files
+// we build a gzip index recording the uncompressed size and a checkpoint every few megabytes,
+// which gives the position of a deflate block and the 32KB of uncompressed data preceding it -
+// all that the decompressor needs to start from that block.  the files themselves are immutable,
+// so the indexes are kept in the state directory and only need to be built once.
+//
+// index files hold the length of the gob-encoded gzipIndex, the gzipIndex itself, and then the
+// flate-compressed checkpoint windows, which are only read when needed.
+
+const gzipWindowSize = 32 * 1024
+
+type gzipIndex struct {
+	CompressedSize int64
+	Size           int64
+	Checkpoints    []gzipCheckpoint
+
+	windows       io.ReaderAt
+	windowsOffset int64
+	file          *os.File
+}
+
+type gzipCheckpoint struct {
+	Uncompressed int64
+	Compressed   int64 // byte offset of the start of the deflate block in the file
+	Bits         uint  // bit offset within that byte
+	WindowOffset int64 // of the compressed window, relative to the start of the windows
+	WindowLength int64
+}
+
+var errGzipIndexMismatch = errors.New("gzip index doesn't match file")
+
+func buildGzipIndex(file io.ReaderAt, compressedSize int64) (*gzipIndex, []byte, error) {
+	index := &gzipIndex{CompressedSize: compressedSize}
+
+	input := bufio.NewReader(io.NewSectionReader(file, 0, compressedSize))
+	headerSize, err := skipGzipHeader(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// we decompress alongside the scan so that we have the window preceding each checkpoint
+	uncompressed, err := gzip.NewReader(io.NewSectionReader(file, 0, compressedSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer uncompressed.Close()
+	position := int64(0)
+	window := make([]byte, gzipWindowSize)
+	var windows bytes.Buffer
+
+	reader := &deflateBitReader{input: input}
+	size, err := scanDeflateBlocks(reader, func(bitOffset, offset int64) error {
+		last := int64(0)
+		if len(index.Checkpoints) > 0 {
+			last = index.Checkpoints[len(index.Checkpoints)-1].Uncompressed
+		}
+		if offset-last < GzipIndexCheckpointInterval {
+			return nil
+		}
+
+		start := offset - gzipWindowSize
+		if start < position {
+			start = position
+		}
+		_, err := io.CopyN(ioutil.Discard, uncompressed, start-position)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(uncompressed, window[:offset-start])
+		if err != nil {
+			return err
+		}
+		position = offset
+
+		checkpoint := gzipCheckpoint{
+			Uncompressed: offset,
+			Compressed:   headerSize + bitOffset/8,
+			Bits:         uint(bitOffset % 8),
+			WindowOffset: int64(windows.Len()),
+		}
+		compressor, _ := flate.NewWriter(&windows, flate.BestSpeed)
+		compressor.Write(window[:offset-start])
+		compressor.Close()
+		checkpoint.WindowLength = int64(windows.Len()) - checkpoint.WindowOffset
+		index.Checkpoints = append(index.Checkpoints, checkpoint)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the trailer gives the size modulo 2^32, which is a useful check that we've scanned correctly
+	reader.alignToByte()
+	_, err = reader.take(32)
+	if err != nil {
+		return nil, nil, err
+	}
+	trailerSize, err := reader.take(32)
+	if err != nil {
+		return nil, nil, err
+	}
+	if trailerSize != uint32(size) {
+		return nil, nil, errGzipIndexMismatch
+	}
+
+	if headerSize+reader.offset()/8 != compressedSize {
+		// there's another gzip member concatenated after the first, which is rare; rather than
+		// indexing each member, we just find the total size and always decompress from the start
+		index.Checkpoints = nil
+		windows.Reset()
+		size, err = gzipDecompressedSize(io.NewSectionReader(file, 0, compressedSize))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	index.Size = size
+	return index, windows.Bytes(), nil
+}
+
+// skipGzipHeader reads the gzip member header, returning its length.
+func skipGzipHeader(input *bufio.Reader) (int64, error) {
+	var header [10]byte
+	_, err := io.ReadFull(input, header[:])
+	if err != nil {
+		return 0, err
+	}
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 {
+		return 0, gzip.ErrHeader
+	}
+	flags := header[3]
+	size := int64(len(header))
+
+	if flags&4 != 0 { // FEXTRA
+		var length [2]byte
+		_, err = io.ReadFull(input, length[:])
+		if err != nil {
+			return 0, err
+		}
+		extra := int(binary.LittleEndian.Uint16(length[:]))
+		_, err = input.Discard(extra)
+		if err != nil {
+			return 0, err
+		}
+		size += int64(len(length) + extra)
+	}
+	for _, flag := range []byte{8, 16} { // FNAME, FCOMMENT
+		if flags&flag != 0 {
+			text, err := input.ReadBytes(0)
+			if err != nil {
+				return 0, err
+			}
+			size += int64(len(text))
+		}
+	}
+	if flags&2 != 0 { // FHCRC
+		_, err = input.Discard(2)
+		if err != nil {
+			return 0, err
+		}
+		size += 2
+	}
+	return size, nil
+}
+
+func gzipDecompressedSize(compressed io.Reader) (int64, error) {
+	uncompressed, err := gzip.NewReader(compressed)
+	if err != nil {
+		return 0, err
+	}
+	defer uncompressed.Close()
+	return io.Copy(ioutil.Discard, uncompressed)
+}
+
+func (index *gzipIndex) save(filename string, windows []byte) error {
+	var header bytes.Buffer
+	err := gob.NewEncoder(&header).Encode(index)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, 8, 8+header.Len()+len(windows))
+	binary.BigEndian.PutUint64(data, uint64(header.Len()))
+	data = append(data, header.Bytes()...)
+	data = append(data, windows...)
+	return writeFileAtomically(filename, data)
+}
+
+func loadGzipIndex(filename string) (*gzipIndex, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var length [8]byte
+	_, err = io.ReadFull(file, length[:])
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	headerLength := int64(binary.BigEndian.Uint64(length[:]))
+
+	index := &gzipIndex{}
+	err = gob.NewDecoder(io.NewSectionReader(file, int64(len(length)), headerLength)).Decode(index)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	index.windows = file
+	index.windowsOffset = int64(len(length)) + headerLength
+	index.file = file
+	return index, nil
+}
+
+func (index *gzipIndex) Close() error {
+	if index.file != nil {
+		return index.file.Close()
+	}
+	return nil
+}
+
+// checkpointBefore returns the last checkpoint at or before the given uncompressed offset, or nil
+// if there isn't one and we need to start from the beginning of the file.
+func (index *gzipIndex) checkpointBefore(offset int64) *gzipCheckpoint {
+	n := sort.Search(len(index.Checkpoints), func(i int) bool { return index.Checkpoints[i].Uncompressed > offset })
+	if n == 0 {
+		return nil
+	}
+	return &index.Checkpoints[n-1]
+}
+
+func (index *gzipIndex) window(checkpoint *gzipCheckpoint) ([]byte, error) {
+	compressed := io.NewSectionReader(index.windows, index.windowsOffset+checkpoint.WindowOffset, checkpoint.WindowLength)
+	decompressor := flate.NewReader(compressed)
+	defer decompressor.Close()
+	return ioutil.ReadAll(decompressor)
+}
+
+// GzipIndexer loads gzip indexes, building them if necessary, either on demand or in the
+// background.
+type GzipIndexer struct {
+	directory string
+	quiet     bool
+	mutex     sync.Mutex
+	building  map[string]chan struct{}
+	queue     chan gzipIndexJob
+}
+
+type gzipIndexJob struct {
+	location string
+	filename string
+}
+
+func NewGzipIndexer(directory string, quiet bool) *GzipIndexer {
+	indexer := &GzipIndexer{
+		directory: directory,
+		quiet:     quiet,
+		building:  make(map[string]chan struct{}),
+		queue:     make(chan gzipIndexJob, GzipIndexQueueSize),
+	}
+	go indexer.buildQueued()
+	return indexer
+}
+
+// index returns the index for the given gzip-encoded file.  if build is false and there's no
+// index yet, it returns nil and queues the index to be built in the background instead of making
+// the caller wait.  small files aren't worth indexing, so for them build means just finding the
+// uncompressed size.
+func (indexer *GzipIndexer) index(location, filename string, compressedSize int64, build bool) (*gzipIndex, error) {
+	if compressedSize < GzipIndexMinimumSize {
+		if !build {
+			return nil, nil
+		}
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		size, err := gzipDecompressedSize(file)
+		if err != nil {
+			return nil, err
+		}
+		return &gzipIndex{CompressedSize: compressedSize, Size: size}, nil
+	}
+
+	index, err := indexer.load(location, compressedSize)
+	if err == nil {
+		return index, nil
+	} else if build {
+		return indexer.build(location, filename)
+	}
+
+	select {
+	case indexer.queue <- gzipIndexJob{location: location, filename: filename}:
+	default:
+		// we'll try again next time the file is requested
+	}
+	return nil, nil
+}
+
+func (indexer *GzipIndexer) indexFilename(location string) string {
+	return indexer.directory + location + ".idx"
+}
+
+// load returns the saved index for the given location, building it if there isn't one.
+func (indexer *GzipIndexer) load(location string, compressedSize int64) (*gzipIndex, error) {
+	index, err := loadGzipIndex(indexer.indexFilename(location))
+	if err == nil && index.CompressedSize != compressedSize {
+		index.Close()
+		err = errGzipIndexMismatch
+	}
+	return index, err
+}
+
+func (indexer *GzipIndexer) build(location, filename string) (*gzipIndex, error) {
+	indexer.mutex.Lock()
+	if done, ok := indexer.building[location]; ok {
+		// another request is already building it, so wait for that and use its result
+		indexer.mutex.Unlock()
+		<-done
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		return indexer.load(location, stat.Size())
+	}
+	done := make(chan struct{})
+	indexer.building[location] = done
+	indexer.mutex.Unlock()
+
+	defer func() {
+		indexer.mutex.Lock()
+		delete(indexer.building, location)
+		indexer.mutex.Unlock()
+		close(done)
+	}()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	index, windows, err := buildGzipIndex(file, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+	index.windows = bytes.NewReader(windows)
+
+	err = index.save(indexer.indexFilename(location), windows)
+	if err != nil {
+		// we can still use it for this request
+		fmt.Fprintf(os.Stderr, "Couldn't save gzip index for %s: %s\n", location, err.Error())
+	} else if !indexer.quiet {
+		fmt.Fprintf(os.Stdout, "Indexed %s\n", location)
+	}
+	return index, nil
+}
+
+func (indexer *GzipIndexer) buildQueued() {
+	for job := range indexer.queue {
+		if _, err := os.Stat(indexer.indexFilename(job.location)); err == nil {
+			// already built, perhaps by a request that needed it before we got to it
+			continue
+		}
+		index, err := indexer.build(job.location, job.filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't build gzip index for %s: %s\n", job.location, err.Error())
+			continue
+		}
+		index.Close()
+	}
+}
+
+// gzipIndexSeeker decompresses a gzip-encoded file, using its index to seek without decompressing
+// everything up to the new position.
+type gzipIndexSeeker struct {
+	compressed   io.ReadSeeker
+	index        *gzipIndex
+	uncompressed io.ReadCloser // nil until the next read
+	position     int64
+}
+
+func (seeker *gzipIndexSeeker) Read(p []byte) (int, error) {
+	if seeker.uncompressed == nil {
+		err := seeker.restart()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := seeker.uncompressed.Read(p)
+	seeker.position += int64(n)
+	return n, err
+}
+
+// restart starts decompressing from the last checkpoint before the current position, and skips
+// forward to the current position.
+func (seeker *gzipIndexSeeker) restart() error {
+	target := seeker.position
+	checkpoint := seeker.index.checkpointBefore(target)
+
+	if checkpoint == nil {
+		_, err := seeker.compressed.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		uncompressed, err := gzip.NewReader(seeker.compressed)
+		if err != nil {
+			return err
+		}
+		seeker.uncompressed = uncompressed
+		seeker.position = 0
+	} else {
+		window, err := seeker.index.window(checkpoint)
+		if err != nil {
+			return err
+		}
+		_, err = seeker.compressed.Seek(checkpoint.Compressed, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		input, err := deflateReaderAt(bufio.NewReader(seeker.compressed), checkpoint.Bits)
+		if err != nil {
+			return err
+		}
+		seeker.uncompressed = flate.NewReaderDict(input, window)
+		seeker.position = checkpoint.Uncompressed
+	}
+
+	_, err := io.CopyN(ioutil.Discard, seeker, target-seeker.position)
+	return err
+}
+
+func (seeker *gzipIndexSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += seeker.position
+	case io.SeekEnd:
+		offset += seeker.index.Size
+	case io.SeekStart:
+	default:
+		return seeker.position, errors.New("invalid whence value")
+	}
+	if offset < 0 {
+		return seeker.position, errors.New("negative position")
+	}
+
+	// carry on reading forward if that's quicker than starting from a checkpoint
+	if seeker.uncompressed != nil && offset >= seeker.position {
+		checkpoint := seeker.index.checkpointBefore(offset)
+		if checkpoint == nil || checkpoint.Uncompressed <= seeker.position {
+			_, err := io.CopyN(ioutil.Discard, seeker, offset-seeker.position)
+			return seeker.position, err
+		}
+	}
+
+	seeker.Close()
+	seeker.position = offset
+	return seeker.position, nil
+}
+
+func (seeker *gzipIndexSeeker) Close() error {
+	if seeker.uncompressed == nil {
+		return nil
+	}
+	err := seeker.uncompressed.Close()
+	seeker.uncompressed = nil
+	return err
+}
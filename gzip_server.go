@@ -1,119 +1,128 @@
 package main
 
 import "compress/gzip"
-import "errors"
 import "io"
 import "net/http"
-import "regexp"
+import "strconv"
+import "strings"
+
+// acceptedEncodingQuality returns the quality value the client gave in its Accept-Encoding header for
+// the given content-coding, following RFC 9110 section 12.5.3: codings not mentioned get the value given
+// for "*" if present, and identity is acceptable unless excluded.  explicit is false if the client didn't
+// send the header at all, in which case any coding is acceptable.
+func acceptedEncodingQuality(req *http.Request, coding string) (quality float64, explicit bool) {
+	values, present := req.Header["Accept-Encoding"]
+	if !present {
+		return 1, false
+	}
+	header := strings.Join(values, ",")
+
+	quality, wildcard := -1.0, -1.0
+	for _, element := range strings.Split(header, ",") {
+		parameters := strings.Split(element, ";")
+		name := strings.ToLower(strings.TrimSpace(parameters[0]))
+		if name == "" {
+			continue
+		}
 
-var gzipExpression = regexp.MustCompile("\\b(x-)?gzip\\b")
+		value := 1.0
+		for _, parameter := range parameters[1:] {
+			parameter = strings.TrimSpace(parameter)
+			if len(parameter) > 2 && strings.EqualFold(parameter[:2], "q=") {
+				parsed, err := strconv.ParseFloat(parameter[2:], 64)
+				if err == nil && parsed >= 0 && parsed <= 1 {
+					value = parsed
+				}
+			}
+		}
 
-func gzipAccepted(req *http.Request) bool {
-	accept := req.Header.Get("Accept-Encoding")
+		// x-gzip is an old alias for gzip
+		if name == coding || (coding == "gzip" && name == "x-gzip") {
+			if value > quality {
+				quality = value
+			}
+		} else if name == "*" {
+			wildcard = value
+		}
+	}
 
-	// spec says we should assume any of the "common" encodings are supported - ie. gzip and compress - if not explicitly told
-	return accept == "" || gzipExpression.MatchString(accept)
+	switch {
+	case quality >= 0:
+		return quality, true
+	case wildcard >= 0:
+		return wildcard, true
+	case coding == "identity":
+		return 1, true
+	default:
+		return 0, true
+	}
 }
 
-type gzipSeeker struct {
-	compressed   io.ReadSeeker
-	uncompressed *gzip.Reader
-	position     int64
-	size         int64
+// gzipAccepted returns true if we should send files stored gzip-encoded as they are, rather than decompressing them.
+func gzipAccepted(req *http.Request) bool {
+	// spec says we should assume any of the "common" encodings are supported - ie. gzip and compress - if not explicitly told,
+	// and if the client has ruled out identity, gzip is better than something it said it doesn't want
+	gzip, _ := acceptedEncodingQuality(req, "gzip")
+	identity, _ := acceptedEncodingQuality(req, "identity")
+	return gzip > 0 || identity == 0
 }
 
-func NewGzipSeeker(compressed io.ReadSeeker, uncompressed *gzip.Reader) (seeker gzipSeeker, err error) {
-	seeker.compressed = compressed
-	seeker.uncompressed = uncompressed
+// gzipPreferred returns true if the client explicitly asked for gzip and would rather have it than the
+// identity encoding, so it's worth compressing files that aren't stored compressed.
+func gzipPreferred(req *http.Request) bool {
+	quality, explicit := acceptedEncodingQuality(req, "gzip")
+	identity, _ := acceptedEncodingQuality(req, "identity")
+	return explicit && quality > 0 && quality >= identity
+}
 
-	// scan through the entire file so we can determine the length, which is required by serveContent (in
-	// order to populate the Content-Range header), and also used to support seeking relative to the end.
-	buf := make([]byte, 4096)
-	var n int
-	for err == nil {
-		n, err = uncompressed.Read(buf)
-		seeker.size += int64(n)
-	}
-	if err != io.EOF {
+// compressAndServeContent serves a file not stored gzip-encoded to a client that prefers gzip.
+func compressAndServeContent(w http.ResponseWriter, req *http.Request, content io.Reader) {
+	// we don't know the compressed size until we've finished, so we can't support ranges
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+	if req.Method == "HEAD" {
 		return
 	}
 
-	_, err = compressed.Seek(0, 0) // second arg = io.SeekStart
+	compressor := gzip.NewWriter(w)
+	_, err := io.Copy(compressor, content)
 	if err == nil {
-		err = uncompressed.Reset(compressed)
+		err = compressor.Close()
 	}
-	return
-}
-
-func (seeker *gzipSeeker) Read(p []byte) (n int, err error) {
-	n, err = seeker.uncompressed.Read(p)
-	seeker.position += int64(n)
-	return
-}
-
-func (seeker *gzipSeeker) Seek(offset int64, whence int) (int64, error) {
-	switch whence {
-	case 0: // io.SeekStart
-		if offset < seeker.position {
-			seeker.position = 0
-			_, err := seeker.compressed.Seek(0, 0) // second arg = io.SeekStart
-			if err == nil {
-				err = seeker.uncompressed.Reset(seeker.compressed)
-			}
-			if err != nil {
-				return 0, err
-			}
-		}
-		buf := make([]byte, 4096)
-		for offset > seeker.position {
-			bytes := offset - seeker.position
-			if bytes > 4096 {
-				bytes = 4096
-			}
-			_, err := seeker.Read(buf[:bytes])
-			if err != nil {
-				return seeker.position, err
-			}
-		}
-		return seeker.position, nil
-
-	case 1: // io.SeekCurrent
-		return seeker.Seek(seeker.position + offset, 0) // second arg = io.SeekStart
-
-	case 2: // io.SeekEnd
-		return seeker.Seek(seeker.size + offset, 0) // second arg = io.SeekStart
-
-	default:
-		return seeker.position, errors.New("invalid whence value")
+	if err != nil {
+		// we've already sent the response code, so abort the response rather than finishing it
+		// normally; otherwise the client would think it had the whole file
+		panic(http.ErrAbortHandler)
 	}
 }
 
-func (seeker *gzipSeeker) Size() int64 {
-	return seeker.size
-}
-
-func unpackAndServeContent(w http.ResponseWriter, req *http.Request, compressed io.ReadSeeker) {
-	uncompressed, err := gzip.NewReader(compressed)
+// unpackAndServeContent serves a file stored gzip-encoded to a client that doesn't accept gzip.
+func (server vermServer) unpackAndServeContent(w http.ResponseWriter, req *http.Request, location string, compressed io.ReadSeeker, compressedSize int64) {
+	// calculating the size of the uncompressed data is expensive, so unless we were asked to send only specific
+	// byte ranges of the file or only the headers, we only use the index if we already have one; otherwise we can
+	// simply stream the entire file to the client using chunked transfer encoding, and index it for next time
+	needSize := req.Header.Get("Range") != "" || req.Method == "HEAD"
+	index, err := server.GzipIndexer.index(location, server.RootDataDir+location+".gz", compressedSize, needSize)
 	if err != nil {
-		http.Error(w, "Couldn't create decompressor", 500)
+		http.Error(w, "Couldn't decompress file "+err.Error(), 500)
 		return
 	}
-	defer uncompressed.Close()
 
-	// calculating the size of the uncompressed data is expensive, so we only do it if it's actually required;
-	// if we weren't asked for to send only specific byte ranges of the file, we can simply stream the entire
-	// file to the client using chunked transfer encoding without finding the size first
-	if req.Header.Get("Range") == "" {
+	if index == nil {
+		uncompressed, err := gzip.NewReader(compressed)
+		if err != nil {
+			http.Error(w, "Couldn't create decompressor", 500)
+			return
+		}
+		defer uncompressed.Close()
+
 		w.WriteHeader(http.StatusOK)
 		io.Copy(w, uncompressed)
 		return
 	}
+	defer index.Close()
 
-	seeker, err := NewGzipSeeker(compressed, uncompressed)
-	if err != nil {
-		http.Error(w, "Couldn't decompress file " + err.Error(), 500)
-		return
-	}
-
-	serveContent(w, req, seeker.Size(), &seeker)
+	seeker := &gzipIndexSeeker{compressed: compressed, index: index}
+	defer seeker.Close()
+	serveContent(w, req, index.Size, seeker)
 }
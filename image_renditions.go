@@ -0,0 +1,412 @@
+package main
+
+import "bytes"
+import "errors"
+import "fmt"
+import "image"
+import "image/color"
+import "image/draw"
+import "image/gif"
+import "image/jpeg"
+import "image/png"
+import "io"
+import "net/http"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "github.com/willbryant/verm/mimeext"
+
+// renditions are resized or converted copies of stored images, requested by adding w, h, fit
+// and format parameters to the image's URL, for example ?w=200&h=200&fit=cover&format=jpeg.
+// they're made on the first request and cached in the state directory, so they aren't
+// replicated; each server makes its own when asked.  to stop clients filling the disk or using
+// up all the memory, only the widths and heights given in the rendition-sizes option can be
+// requested, and only images up to RenditionMaxSourcePixels can be resized.
+
+type renditionRequest struct {
+	width, height int    // 0 to keep the aspect ratio
+	fit           string // contain, cover or fill
+	format        string // jpeg, png or gif
+}
+
+var renditionFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+var renditionContentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+}
+
+var errRenditionTooLarge = errors.New("image is too large to resize")
+
+type RenditionMaker struct {
+	directory string
+	sizes     []int
+	mutex     sync.Mutex
+	building  map[string]chan struct{}
+	slots     chan struct{}
+}
+
+func NewRenditionMaker(directory string, sizes []int) *RenditionMaker {
+	return &RenditionMaker{
+		directory: directory,
+		sizes:     sizes,
+		building:  make(map[string]chan struct{}),
+		slots:     make(chan struct{}, RenditionConcurrency),
+	}
+}
+
+// ParseRenditionSizes parses a comma-separated list of the widths and heights that may be
+// requested, for the rendition-sizes option.
+func ParseRenditionSizes(value string) ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(value, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size < 1 || size > RenditionMaxSize {
+			return nil, fmt.Errorf("rendition sizes must be numbers of pixels from 1 to %d", RenditionMaxSize)
+		}
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// renditionRequested returns true if the client asked for a rendition rather than the stored file.
+func renditionRequested(req *http.Request) bool {
+	query := req.URL.Query()
+	return query.Get("w") != "" || query.Get("h") != "" || query.Get("fit") != "" || query.Get("format") != ""
+}
+
+func (maker *RenditionMaker) parseRequest(req *http.Request, sourceFormat string) (*renditionRequest, error) {
+	query := req.URL.Query()
+	rendition := &renditionRequest{fit: query.Get("fit"), format: query.Get("format")}
+
+	var err error
+	if value := query.Get("w"); value != "" {
+		if rendition.width, err = maker.parseSize(value); err != nil {
+			return nil, err
+		}
+	}
+	if value := query.Get("h"); value != "" {
+		if rendition.height, err = maker.parseSize(value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch rendition.fit {
+	case "":
+		rendition.fit = "contain"
+	case "contain", "cover", "fill":
+	default:
+		return nil, fmt.Errorf("fit must be contain, cover or fill")
+	}
+
+	switch rendition.format {
+	case "":
+		rendition.format = sourceFormat
+	case "jpg":
+		rendition.format = "jpeg"
+	case "jpeg", "png", "gif":
+	default:
+		return nil, fmt.Errorf("format must be jpeg, png or gif")
+	}
+	return rendition, nil
+}
+
+func (maker *RenditionMaker) parseSize(value string) (int, error) {
+	size, err := strconv.Atoi(value)
+	if err == nil {
+		index := sort.SearchInts(maker.sizes, size)
+		if index < len(maker.sizes) && maker.sizes[index] == size {
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("width and height must be one of %s", strings.Trim(fmt.Sprint(maker.sizes), "[]"))
+}
+
+func (rendition *renditionRequest) key() string {
+	return fmt.Sprintf("%dx%d-%s.%s", rendition.width, rendition.height, rendition.fit, rendition.format)
+}
+
+func (maker *RenditionMaker) renditionFilename(location string, rendition *renditionRequest) string {
+	return maker.directory + location + "/" + rendition.key()
+}
+
+func (server vermServer) serveRendition(w http.ResponseWriter, req *http.Request, location string, source io.Reader, stat os.FileInfo, encoding string) {
+	sourceFormat, ok := renditionFormats[mimeext.TypeByExtension(filepath.Ext(location))]
+	if !ok {
+		http.Error(w, "Renditions can only be made of JPEG, PNG and GIF images", 400)
+		return
+	}
+
+	rendition, err := server.Renditions.parseRequest(req, sourceFormat)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	if tag := locationHash(location); tag != "" {
+		w.Header().Set("ETag", `"`+tag+"-"+rendition.key()+`"`)
+	}
+	if server.CacheMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", server.CacheMaxAge))
+	}
+
+	// name downloads after the original, but with the extension for the format we're sending
+	defaultFilename := ""
+	if server.RememberFilenames {
+		if filename := server.rememberedFilename(location); filename != "" {
+			defaultFilename = strings.TrimSuffix(filename, filepath.Ext(filename)) + mimeext.ExtensionByType(renditionContentTypes[rendition.format])
+		}
+	}
+	setContentDisposition(w, req, defaultFilename)
+
+	if checkPreconditions(w, req, stat.ModTime()) {
+		return
+	}
+
+	file, err := server.Renditions.open(location, rendition, source, encoding)
+	if err == errRenditionTooLarge {
+		http.Error(w, err.Error(), 422)
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't make rendition %s of %s: %s\n", rendition.key(), location, err.Error())
+		http.Error(w, "Couldn't make rendition", 500)
+		return
+	}
+	defer file.Close()
+
+	renditionStat, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", renditionContentTypes[rendition.format])
+	serveContent(w, req, renditionStat.Size(), file)
+}
+
+// open returns the cached rendition, making it first if it hasn't been made yet.
+func (maker *RenditionMaker) open(location string, rendition *renditionRequest, source io.Reader, encoding string) (*os.File, error) {
+	filename := maker.renditionFilename(location, rendition)
+	file, err := os.Open(filename)
+	if err == nil || !os.IsNotExist(err) {
+		return file, err
+	}
+
+	maker.mutex.Lock()
+	if done, ok := maker.building[filename]; ok {
+		// another request is already making it, so wait for that and use its result
+		maker.mutex.Unlock()
+		<-done
+		return os.Open(filename)
+	}
+	done := make(chan struct{})
+	maker.building[filename] = done
+	maker.mutex.Unlock()
+
+	defer func() {
+		maker.mutex.Lock()
+		delete(maker.building, filename)
+		maker.mutex.Unlock()
+		close(done)
+	}()
+
+	// decoding and resizing large images uses a lot of memory, so limit how many we do at once
+	maker.slots <- struct{}{}
+	defer func() { <-maker.slots }()
+
+	data, err := makeRendition(rendition, source, encoding)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomically(filename, data)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filename)
+}
+
+func makeRendition(rendition *renditionRequest, source io.Reader, encoding string) ([]byte, error) {
+	input, err := EncodingDecoder(encoding, source)
+	if err != nil {
+		return nil, err
+	}
+
+	// check the size before decoding, so that a small file can't make us allocate a huge image
+	header := &recordingReader{input: input}
+	config, _, err := image.DecodeConfig(header)
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > RenditionMaxSourcePixels {
+		return nil, errRenditionTooLarge
+	}
+
+	decoded, _, err := image.Decode(io.MultiReader(bytes.NewReader(header.recorded), input))
+	if err != nil {
+		return nil, err
+	}
+	output := resizeImage(decoded, rendition)
+
+	var buffer bytes.Buffer
+	switch rendition.format {
+	case "jpeg":
+		err = jpeg.Encode(&buffer, output, &jpeg.Options{Quality: RenditionJPEGQuality})
+	case "png":
+		err = png.Encode(&buffer, output)
+	case "gif":
+		err = gif.Encode(&buffer, output, nil)
+	}
+	return buffer.Bytes(), err
+}
+
+// recordingReader keeps a copy of what's read, so it can be read again.
+type recordingReader struct {
+	input    io.Reader
+	recorded []byte
+}
+
+func (reader *recordingReader) Read(p []byte) (int, error) {
+	n, err := reader.input.Read(p)
+	reader.recorded = append(reader.recorded, p[:n]...)
+	return n, err
+}
+
+// resizeImage returns the requested rendition of the image.  we average the source pixels
+// covering each output pixel, which gives good results when shrinking images, as thumbnails
+// mostly are.
+func resizeImage(source image.Image, rendition *renditionRequest) *image.RGBA {
+	bounds := source.Bounds()
+	width, height := rendition.width, rendition.height
+	crop := bounds
+
+	switch {
+	case width == 0 && height == 0:
+		width, height = bounds.Dx(), bounds.Dy()
+	case width == 0:
+		width = maxInt(1, bounds.Dx()*height/bounds.Dy())
+	case height == 0:
+		height = maxInt(1, bounds.Dy()*width/bounds.Dx())
+	case rendition.fit == "contain":
+		// shrink whichever side would otherwise be too big
+		if bounds.Dx()*height > bounds.Dy()*width {
+			height = maxInt(1, bounds.Dy()*width/bounds.Dx())
+		} else {
+			width = maxInt(1, bounds.Dx()*height/bounds.Dy())
+		}
+	case rendition.fit == "cover":
+		// use the middle of the image, cropping whichever side would otherwise be too big
+		if bounds.Dx()*height > bounds.Dy()*width {
+			cropWidth := maxInt(1, bounds.Dy()*width/height)
+			crop.Min.X += (bounds.Dx() - cropWidth) / 2
+			crop.Max.X = crop.Min.X + cropWidth
+		} else {
+			cropHeight := maxInt(1, bounds.Dx()*height/width)
+			crop.Min.Y += (bounds.Dy() - cropHeight) / 2
+			crop.Max.Y = crop.Min.Y + cropHeight
+		}
+	}
+
+	// work in premultiplied colours, so that transparent pixels don't tint their neighbours
+	input := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(input, input.Bounds(), source, crop.Min, draw.Src)
+	if rendition.format == "jpeg" && !input.Opaque() {
+		// JPEG doesn't support transparency, so show what's behind it as white rather than black
+		background := image.NewRGBA(input.Bounds())
+		draw.Draw(background, background.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(background, background.Bounds(), input, image.Point{}, draw.Over)
+		input = background
+	}
+	if width == crop.Dx() && height == crop.Dy() {
+		return input
+	}
+
+	// resize horizontally then vertically, which gives the same result as resizing in one step
+	horizontal := resampleRows(input.Pix, input.Stride, crop.Dx(), crop.Dy(), width)
+	vertical := resampleRows(transpose(horizontal, width, crop.Dy()), crop.Dy()*4, crop.Dy(), width, height)
+
+	output := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			for channel := 0; channel < 4; channel++ {
+				output.Pix[y*output.Stride+x*4+channel] = clampUint8(vertical[(x*height+y)*4+channel])
+			}
+		}
+	}
+	return output
+}
+
+// resampleRows resizes each row of an image from width to newWidth pixels, returning the
+// result as float RGBA values.
+func resampleRows(pixels []uint8, stride, width, height, newWidth int) []float32 {
+	output := make([]float32, newWidth*height*4)
+	scale := float64(width) / float64(newWidth)
+	for x := 0; x < newWidth; x++ {
+		// the output pixel covers the source from start to end, which may include parts of pixels
+		start, end := float64(x)*scale, float64(x+1)*scale
+		for y := 0; y < height; y++ {
+			var sums [4]float64
+			for sourceX := int(start); float64(sourceX) < end && sourceX < width; sourceX++ {
+				weight := minFloat(end, float64(sourceX+1)) - maxFloat(start, float64(sourceX))
+				for channel := 0; channel < 4; channel++ {
+					sums[channel] += weight * float64(pixels[y*stride+sourceX*4+channel])
+				}
+			}
+			for channel := 0; channel < 4; channel++ {
+				output[(y*newWidth+x)*4+channel] = float32(sums[channel] / scale)
+			}
+		}
+	}
+	return output
+}
+
+// transpose swaps the rows and columns of float RGBA values, rounding them back to bytes.
+func transpose(pixels []float32, width, height int) []uint8 {
+	output := make([]uint8, len(pixels))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			for channel := 0; channel < 4; channel++ {
+				output[(x*height+y)*4+channel] = clampUint8(pixels[(y*width+x)*4+channel])
+			}
+		}
+	}
+	return output
+}
+
+func clampUint8(value float32) uint8 {
+	if value <= 0 {
+		return 0
+	} else if value >= 255 {
+		return 255
+	}
+	return uint8(value + 0.5)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
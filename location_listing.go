@@ -0,0 +1,86 @@
+package main
+
+import "os"
+import "sort"
+import "strings"
+
+// listLocations calls emit with the location of each file stored under the given directory, in
+// the order given by compareLocations, so that two listings can be compared by merging them
+// rather than by holding either in memory.  files stored both compressed and uncompressed are
+// only listed once.  skip is called with each path under the directory, and if it returns true
+// the path and anything under it aren't listed.
+func listLocations(root, directory string, skip func(string) bool, emit func(string) error) error {
+	previous := ""
+	return listLocationsUnder(root, strings.TrimSuffix(directory, "/"), skip, func(location string) error {
+		if location == previous {
+			return nil
+		}
+		previous = location
+		return emit(location)
+	})
+}
+
+func listLocationsUnder(root, directory string, skip func(string) bool, emit func(string) error) error {
+	dir, err := os.Open(root + directory)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	list, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	// sort by location rather than filename, so that compressed files sort in the same place as
+	// uncompressed files, and put files before directories of the same name (which also means
+	// before anything in those directories)
+	sort.Slice(list, func(i, j int) bool {
+		iname, jname := strings.TrimSuffix(list[i].Name(), ".gz"), strings.TrimSuffix(list[j].Name(), ".gz")
+		if iname != jname {
+			return iname < jname
+		}
+		return !list[i].IsDir() && list[j].IsDir()
+	})
+
+	for _, fileinfo := range list {
+		if strings.HasPrefix(fileinfo.Name(), "_upload") {
+			continue
+		}
+		expanded := directory + "/" + fileinfo.Name()
+		if skip(expanded) {
+			continue
+		}
+		if fileinfo.Mode().IsRegular() {
+			err = emit(strings.TrimSuffix(expanded, ".gz"))
+		} else if fileinfo.IsDir() {
+			err = listLocationsUnder(root, expanded, skip, emit)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareLocations orders locations by comparing each of their path components in turn, which is
+// the order listLocations lists them in.  it returns -1 if a comes first, 1 if b comes first, or
+// 0 if they are the same.
+func compareLocations(a, b string) int {
+	acomponents, bcomponents := strings.Split(a, "/"), strings.Split(b, "/")
+	for index := 0; index < len(acomponents) && index < len(bcomponents); index++ {
+		if acomponents[index] != bcomponents[index] {
+			if acomponents[index] < bcomponents[index] {
+				return -1
+			}
+			return 1
+		}
+	}
+	if len(acomponents) < len(bcomponents) {
+		return -1
+	} else if len(acomponents) > len(bcomponents) {
+		return 1
+	}
+	return 0
+}
@@ -10,7 +10,11 @@ type LogStatistics struct {
 	GetRequests, GetRequestsFoundOnReplica, GetRequestsNotFound                            PrometheusMetric
 	PostRequests, PostRequestsNewFileStored, PostRequestsFailed                            PrometheusMetric
 	PutRequests, PutRequestsNewFileStored, PutRequestsMissingFileChecks, PutRequestsFailed PrometheusMetric
+	PutRequestsBatchedFiles                                                                PrometheusMetric
 	ReplicationPushAttempts, ReplicationPushAttemptsFailed                                 PrometheusMetric
+	ReplicationPullAttempts, ReplicationPullAttemptsFailed                                 PrometheusMetric
+	CorruptFilesQuarantined                                                                PrometheusMetric
+	ScrubFilesChecked, ScrubCorruptFiles, ScrubLastPassCompleted                           PrometheusMetric
 	ConnectionsCurrent                                                                     PrometheusMetric
 }
 
@@ -66,6 +70,11 @@ func NewLogStatistics() *LogStatistics {
 			metricType: "counter",
 			description: "PUT requests failed",
 		}),
+		PutRequestsBatchedFiles: NewPrometheusMetric(&promMetricOptions{
+			name: "verm_put_requests_batched_files_total",
+			metricType: "counter",
+			description: "Files received in batch replication PUT requests",
+		}),
 		ReplicationPushAttempts: NewPrometheusMetric(&promMetricOptions{
 			name: "verm_replication_push_attempts_total",
 			metricType: "counter",
@@ -76,6 +85,36 @@ func NewLogStatistics() *LogStatistics {
 			metricType: "counter",
 			description: "Replication push attempts failed",
 		}),
+		ReplicationPullAttempts: NewPrometheusMetric(&promMetricOptions{
+			name: "verm_replication_pull_attempts_total",
+			metricType: "counter",
+			description: "Replication pull attempts",
+		}),
+		ReplicationPullAttemptsFailed: NewPrometheusMetric(&promMetricOptions{
+			name: "verm_replication_pull_attempts_failed_total",
+			metricType: "counter",
+			description: "Replication pull attempts failed",
+		}),
+		CorruptFilesQuarantined: NewPrometheusMetric(&promMetricOptions{
+			name: "verm_corrupt_files_quarantined_total",
+			metricType: "counter",
+			description: "Stored files found to be corrupt and quarantined",
+		}),
+		ScrubFilesChecked: NewPrometheusMetric(&promMetricOptions{
+			name: "verm_scrub_files_checked_total",
+			metricType: "counter",
+			description: "Stored files rehashed by the scrubber",
+		}),
+		ScrubCorruptFiles: NewPrometheusMetric(&promMetricOptions{
+			name: "verm_scrub_corrupt_files_total",
+			metricType: "counter",
+			description: "Stored files found to be corrupt by the scrubber",
+		}),
+		ScrubLastPassCompleted: NewPrometheusMetric(&promMetricOptions{
+			name: "verm_scrub_last_pass_completed_timestamp_seconds",
+			metricType: "gauge",
+			description: "Time the scrubber last finished checking all stored files",
+		}),
 		ConnectionsCurrent: NewPrometheusMetric(&promMetricOptions{
 			name: "verm_connections_current",
 			metricType: "gauge",
@@ -96,14 +135,22 @@ func (server vermServer) serveStatistics(w http.ResponseWriter, req *http.Reques
 	server.Statistics.PutRequestsNewFileStored.PrintStatistics(w)
 	server.Statistics.PutRequestsMissingFileChecks.PrintStatistics(w)
 	server.Statistics.PutRequestsFailed.PrintStatistics(w)
+	server.Statistics.PutRequestsBatchedFiles.PrintStatistics(w)
 	server.Statistics.ReplicationPushAttempts.PrintStatistics(w)
 	server.Statistics.ReplicationPushAttemptsFailed.PrintStatistics(w)
+	server.Statistics.ReplicationPullAttempts.PrintStatistics(w)
+	server.Statistics.ReplicationPullAttemptsFailed.PrintStatistics(w)
+	server.Statistics.CorruptFilesQuarantined.PrintStatistics(w)
+	server.Statistics.ScrubFilesChecked.PrintStatistics(w)
+	server.Statistics.ScrubCorruptFiles.PrintStatistics(w)
+	server.Statistics.ScrubLastPassCompleted.PrintStatistics(w)
 	server.Statistics.ConnectionsCurrent.PrintStatistics(w)
 	fmt.Fprintf(w, "%s", replicationTargets.StatisticsString())
 }
 
 type PrometheusMetric interface {
 	Add(int64)
+	Set(int64)
 	PrintStatistics(w http.ResponseWriter)
 }
 
@@ -130,4 +177,8 @@ func (pi *promMetric) PrintStatistics(w http.ResponseWriter) {
 
 func (pi *promMetric) Add(val int64) {
 	pi.metric.Add(val)
+}
+
+func (pi *promMetric) Set(val int64) {
+	pi.metric.Set(val)
 }
\ No newline at end of file
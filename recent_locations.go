@@ -0,0 +1,55 @@
+package main
+
+import "sync"
+import "time"
+
+// recentLocations remembers locations for at least the given period, and at most twice that.
+// rather than timestamping each location, we keep two generations and throw away the older one
+// each period, so that looking a location up doesn't need to prune the whole set.
+type recentLocations struct {
+	mutex    sync.Mutex
+	period   time.Duration
+	rotated  time.Time
+	current  map[string]struct{}
+	previous map[string]struct{}
+}
+
+func newRecentLocations(period time.Duration) *recentLocations {
+	return &recentLocations{
+		period:   period,
+		rotated:  time.Now(),
+		current:  make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+	}
+}
+
+func (recent *recentLocations) add(location string) {
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+	recent.rotate()
+	recent.current[location] = struct{}{}
+}
+
+func (recent *recentLocations) contains(location string) bool {
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+	recent.rotate()
+	_, current := recent.current[location]
+	_, previous := recent.previous[location]
+	return current || previous
+}
+
+// must be called with the mutex held.
+func (recent *recentLocations) rotate() {
+	now := time.Now()
+	if now.Sub(recent.rotated) < recent.period {
+		return
+	}
+	if now.Sub(recent.rotated) < 2*recent.period {
+		recent.previous = recent.current
+	} else {
+		recent.previous = make(map[string]struct{})
+	}
+	recent.current = make(map[string]struct{})
+	recent.rotated = now
+}
@@ -6,6 +6,8 @@ import "net"
 import "net/http"
 import "regexp"
 import "os"
+import "sort"
+import "sync/atomic"
 import "time"
 
 var proxyTransport *http.Transport = &http.Transport{
@@ -31,8 +33,13 @@ var headerFieldsToReturn = []string{
 	"Content-Encoding",
 	"Content-Length",
 	"Content-Range",
+	"Content-Disposition",
 	"Last-Modified",
 	"ETag",
+	"Cache-Control",
+	"Vary",
+	"Repr-Digest",
+	"Content-Digest",
 }
 
 func copyHeaderField(src, dst http.Header, field string) {
@@ -79,26 +86,53 @@ func (server vermServer) forwardRead(w http.ResponseWriter, req *http.Request) b
 }
 
 func (targets *ReplicationTargets) forwardRequest(w http.ResponseWriter, req *http.Request, out chan *http.Response) {
-	responses := make(chan *http.Response)
-
-	for _, target := range targets.targets {
-		go target.forwardRequest(w, req, responses)
+	// rather than firing the request at every replica at once, we try the nearest replica first,
+	// and only send hedged requests to the next nearest if it hasn't answered within the hedge
+	// delay - or straight away if it answered that it doesn't have the file.  this keeps most
+	// requests within the local datacentre without letting one slow replica hold up the response.
+	ordered := targets.forwardingOrder()
+	responses := make(chan *http.Response, len(ordered))
+	started := 0
+	var hedge <-chan time.Time
+
+	startNext := func() {
+		go ordered[started].forwardRequest(w, req, responses)
+		started++
+		if started < len(ordered) {
+			hedge = time.After(ReplicaHedgeDelay * time.Millisecond)
+		} else {
+			hedge = nil
+		}
 	}
 
 	success := false
-	for _, _ = range targets.targets {
-		resp := <-responses
-
-		// resp will be nil if this target failed
-		if resp != nil {
-			if success {
-				// if we've already passed on another response, just clean up the connection so it can be reused, per http package docs
-				resp.Body.Close()
-			} else {
-				// this response won the race, pass it on
-				success = true
-				out <- resp
-				// keep iterating so we can close any other response bodies as above
+	if len(ordered) > 0 {
+		startNext()
+	}
+	for finished := 0; finished < started; {
+		select {
+		case resp := <-responses:
+			finished++
+
+			// resp will be nil if this target failed
+			if resp != nil {
+				if success {
+					// if we've already passed on another response, just clean up the connection so it can be reused, per http package docs
+					resp.Body.Close()
+				} else {
+					// this response won the race, pass it on
+					success = true
+					out <- resp
+					// keep iterating so we can close any other response bodies as above
+				}
+			} else if !success && started < len(ordered) {
+				// no point waiting for the hedge delay, move straight on to the next replica
+				startNext()
+			}
+
+		case <-hedge:
+			if !success {
+				startNext()
 			}
 		}
 	}
@@ -110,36 +144,96 @@ func (targets *ReplicationTargets) forwardRequest(w http.ResponseWriter, req *ht
 	close(responses)
 }
 
+// forwardingOrder returns the targets with those in our own locality first, then in order of
+// their measured response times.  replicas we haven't measured yet are assumed to take
+// ReplicaHedgeDelay, so that they're tried after those known to be fast but before slow ones.
+func (targets *ReplicationTargets) forwardingOrder() []*ReplicationTarget {
+	ordered := make([]*ReplicationTarget, len(targets.targets))
+	copy(ordered, targets.targets)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		iLocal := ordered[i].locality == targets.Locality
+		jLocal := ordered[j].locality == targets.Locality
+		if iLocal != jLocal {
+			return iLocal
+		}
+		return ordered[i].expectedLatency() < ordered[j].expectedLatency()
+	})
+	return ordered
+}
+
 func (target *ReplicationTarget) forwardRequest(w http.ResponseWriter, reqIn *http.Request, out chan *http.Response) {
-	path := fmt.Sprintf("http://%s:%s%s?forward=0", target.hostname, target.port, reqIn.URL.Path)
+	if !target.health.available() {
+		// marked down and not due for a probe yet, don't make the client wait for it
+		out <- nil
+		return
+	}
+
+	// pass on any parameters, such as for renditions, but stop the target asking its own replicas
+	query := reqIn.URL.Query()
+	query.Set("forward", "0")
+	path := fmt.Sprintf("http://%s:%s%s?%s", target.hostname, target.port, reqIn.URL.Path, query.Encode())
 	reqOut, err := http.NewRequest("GET", path, nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error setting up request for %s: %s\n", path, err.Error())
 		out <- nil
+		return
 	}
 
 	copyHeaderField(reqIn.Header, reqOut.Header, "Accept-Encoding")
 
+	requested := time.Now()
 	resp, err := proxyClient.Do(reqOut)
+	if err == nil {
+		target.recordLatency(time.Since(requested))
+	}
 
 	if err != nil {
 		// unexpected failure
 		fmt.Fprintf(os.Stderr, "Error requesting %s: %s\n", path, err.Error())
+		target.health.failed(target)
 		out <- nil
 
 	} else if resp.StatusCode == http.StatusOK {
 		// success - pass on the response and let the other end close the response
+		target.health.succeeded(target)
 		out <- resp
 
 	} else if resp.StatusCode == http.StatusNotFound {
 		// normal missing case
+		target.health.succeeded(target)
 		resp.Body.Close()
 		out <- nil
 
 	} else {
 		// unexpected HTTP error
 		fmt.Fprintf(os.Stderr, "HTTP error requesting %s: %d\n", path, resp.StatusCode)
+		target.health.failed(target)
 		resp.Body.Close()
 		out <- nil
 	}
 }
+
+func (target *ReplicationTarget) recordLatency(elapsed time.Duration) {
+	for {
+		previous := atomic.LoadInt64(&target.latency)
+		average := int64(elapsed)
+		if previous != 0 {
+			// exponentially-weighted moving average
+			average = previous + (int64(elapsed)-previous)/ReplicaLatencyWeight
+		}
+		if atomic.CompareAndSwapInt64(&target.latency, previous, average) {
+			return
+		}
+	}
+}
+
+func (target *ReplicationTarget) averageLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&target.latency))
+}
+
+func (target *ReplicationTarget) expectedLatency() time.Duration {
+	if latency := target.averageLatency(); latency != 0 {
+		return latency
+	}
+	return ReplicaHedgeDelay * time.Millisecond
+}
@@ -0,0 +1,74 @@
+package main
+
+import "fmt"
+import "os"
+import "sync"
+import "time"
+
+// replicaHealth is a simple circuit breaker for read forwarding.  without it, every local miss
+// on a hash-like path would wait for ReplicaProxyTimeout on any replica that has died.  after
+// ReplicaFailureThreshold consecutive failures we mark the replica down and stop forwarding to
+// it, except that every ReplicaProbeInterval we let a single request through as a probe; if that
+// succeeds, the replica is marked back up.  the probe's result isn't always reported, such as
+// when it's cancelled because another replica answered first, so we give up waiting for it after
+// ReplicaProxyTimeout and let another request through.
+type replicaHealth struct {
+	mutex               sync.Mutex
+	consecutiveFailures uint
+	down                bool
+	probing             bool
+	probeStarted        time.Time
+	nextProbe           time.Time
+}
+
+func (health *replicaHealth) available() bool {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if !health.down {
+		return true
+	}
+
+	// half-open; let exactly one request through once the probe interval has passed
+	now := time.Now()
+	if (health.probing && now.Before(health.probeStarted.Add(ReplicaProxyTimeout*time.Second))) || now.Before(health.nextProbe) {
+		return false
+	}
+	health.probing = true
+	health.probeStarted = now
+	return true
+}
+
+func (health *replicaHealth) succeeded(target *ReplicationTarget) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if health.down {
+		fmt.Fprintf(os.Stderr, "Replica %s:%s is responding again, resuming read forwarding\n", target.hostname, target.port)
+	}
+	health.consecutiveFailures = 0
+	health.down = false
+	health.probing = false
+}
+
+func (health *replicaHealth) failed(target *ReplicationTarget) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.consecutiveFailures++
+	if health.down {
+		// the probe failed, wait for another interval
+		health.probing = false
+		health.nextProbe = time.Now().Add(ReplicaProbeInterval * time.Second)
+	} else if health.consecutiveFailures >= ReplicaFailureThreshold {
+		fmt.Fprintf(os.Stderr, "Replica %s:%s failed %d times in a row, suspending read forwarding\n", target.hostname, target.port, health.consecutiveFailures)
+		health.down = true
+		health.nextProbe = time.Now().Add(ReplicaProbeInterval * time.Second)
+	}
+}
+
+func (health *replicaHealth) state() (up bool, consecutiveFailures uint) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	return !health.down, health.consecutiveFailures
+}
@@ -0,0 +1,332 @@
+package main
+
+import "archive/tar"
+import "bufio"
+import "bytes"
+import "compress/gzip"
+import "crypto/sha256"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "path"
+import "strconv"
+import "strings"
+import "sync/atomic"
+import "time"
+
+// replicating lots of small files one request at a time is dominated by per-request overhead, so
+// workers coalesce small files waiting in the queue into a batch, which is sent as a single tar
+// stream PUT to /_batch.  each tar entry is named by the file's location, with the VERM.encoding
+// PAX record set if the content is gzip-encoded, exactly as it would be for a regular replication
+// PUT.  the response lists the outcome for each entry, one per line, as the HTTP status code that
+// a regular PUT would have returned followed by the location and any error message.
+
+const batchEncodingRecord = "VERM.encoding"
+
+func (server vermServer) serveBatch(w http.ResponseWriter, req *http.Request) {
+	input, err := EncodingDecoder(req.Header.Get("Content-Encoding"), req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// as for serveMissing, we have to buffer the response until we've read the whole request
+	var buf bytes.Buffer
+	directories := make(map[string]struct{})
+
+	archive := tar.NewReader(input)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			server.Statistics.PutRequestsFailed.Add(1)
+			http.Error(w, "Couldn't read batch: "+err.Error(), 400)
+			return
+		}
+
+		location := path.Clean("/" + header.Name)
+		newFile, err := server.uploadBatchEntry(location, header.PAXRecords[batchEncodingRecord], archive)
+		server.Statistics.PutRequestsBatchedFiles.Add(1)
+		if err != nil {
+			server.Statistics.PutRequestsFailed.Add(1)
+			status := 500
+			switch err.(type) {
+			case *WrongLocationError:
+				status = 422
+			case *ReservedPathError:
+				status = 403
+			default:
+				if server.Active() {
+					fmt.Fprintf(os.Stderr, "Error storing %s from batch: %s\n", header.Name, err.Error())
+				}
+			}
+			fmt.Fprintf(&buf, "%d %s %s\r\n", status, location, strings.Replace(err.Error(), "\n", " ", -1))
+			continue
+		}
+
+		if newFile {
+			server.Statistics.PutRequestsNewFileStored.Add(1)
+			directories[path.Dir(server.RootDataDir+location)] = struct{}{}
+		}
+		fmt.Fprintf(&buf, "%d %s\r\n", http.StatusCreated, location)
+	}
+
+	// the files themselves have been synced, but we left the directory syncs until the end so we
+	// only need to do each once
+	for directory := range directories {
+		syncDirectory(directory)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't write response: %s\n", err.Error())
+	}
+}
+
+func (server vermServer) uploadBatchEntry(location, encoding string, input io.Reader) (newFile bool, err error) {
+	path, err := locationDirectory(location)
+	if err != nil {
+		return
+	}
+
+	directory, err := server.uploadDirectory(path)
+	if err != nil {
+		return
+	}
+
+	tempFile, err := ioutil.TempFile(directory, "_upload")
+	if err != nil {
+		return
+	}
+
+	// as in FileUploader, store the file as sent but hash the decoded contents
+	decoded, err := EncodingDecoder(encoding, io.TeeReader(input, tempFile))
+	uploader := &fileUpload{
+		replicating:        true,
+		root:               server.RootDataDir,
+		path:               path,
+		location:           location,
+		contentType:        "application/octet-stream",
+		encoding:           encoding,
+		input:              decoded,
+		hasher:             sha256.New(),
+		tempFile:           tempFile,
+		deferDirectorySync: true,
+	}
+	defer uploader.Close()
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(uploader.hasher, uploader.input)
+	if err != nil {
+		return
+	}
+
+	_, newFile, err = uploader.Finish(server.Targets)
+	return
+}
+
+type batchFile struct {
+	location string
+	encoding string
+	data     []byte
+}
+
+// replicationFileSize returns the size of the file stored for the given location, which may be
+// stored gzip-encoded.
+func replicationFileSize(rootDataDirectory, location string) (int64, error) {
+	stat, err := os.Stat(rootDataDirectory + location + ".gz")
+	if err != nil {
+		stat, err = os.Stat(rootDataDirectory + location)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (target *ReplicationTarget) smallFile(location string) bool {
+	size, err := replicationFileSize(target.rootDataDirectory, location)
+	return err == nil && size <= ReplicationBatchFileSizeLimit
+}
+
+// collectBatch takes further small files off the queue to go in a batch with the given file, for
+// up to ReplicationBatchTime or until the batch is full.  any large files that come off the queue
+// in the meantime are returned separately.
+func (target *ReplicationTarget) collectBatch(lane replicationLane, location string) (batch []string, others []string) {
+	batch = append(batch, location)
+	size, _ := replicationFileSize(target.rootDataDirectory, location)
+	timeout := time.After(ReplicationBatchTime * time.Millisecond)
+
+	for size < ReplicationBatchSize && len(batch) < ReplicationBatchMaxFiles {
+		var ok bool
+		location, ok = target.nextJob(lane, timeout)
+		if !ok {
+			return
+		}
+
+		fileSize, err := replicationFileSize(target.rootDataDirectory, location)
+		if err == nil && fileSize <= ReplicationBatchFileSizeLimit {
+			batch = append(batch, location)
+			size += fileSize
+		} else {
+			others = append(others, location)
+		}
+	}
+	return
+}
+
+// replicateBatch replicates the given files in a single request if possible, falling back to
+// replicating them individually if that doesn't succeed.
+func (target *ReplicationTarget) replicateBatch(worker *replicationWorker, locations []string) {
+	results := make(map[string]error)
+	var files []batchFile
+	for _, location := range locations {
+		file, err := readBatchFile(target.rootDataDirectory, location)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't open file for replication: %s\n", err.Error())
+			results[location] = &ReplicationError{message: err.Error(), permanent: os.IsNotExist(err)}
+			continue
+		}
+		files = append(files, file)
+	}
+
+	if len(files) > 0 {
+		worker.started(locations[0], len(locations))
+		worker.attempted(1)
+		var size int64
+		for _, file := range files {
+			size += int64(len(file.data))
+		}
+		started := time.Now()
+		err := target.sendBatch(files, results)
+		if err != nil {
+			target.concurrency.failed()
+			worker.failed(err, 0)
+		} else {
+			target.concurrency.succeeded(size, time.Since(started))
+		}
+	}
+
+	for _, location := range locations {
+		err, ok := results[location]
+		target.statistics.ReplicationPushAttempts.Add(1)
+		if !ok {
+			// no result, most likely because the batch as a whole failed; try again by itself
+			target.statistics.ReplicationPushAttemptsFailed.Add(1)
+			target.replicateFile(worker, location)
+		} else if isPermanentReplicationFailure(err) {
+			target.statistics.ReplicationPushAttemptsFailed.Add(1)
+			target.deadLetters.add(location, err)
+		} else if err != nil {
+			target.statistics.ReplicationPushAttemptsFailed.Add(1)
+			target.replicateFile(worker, location)
+		}
+		atomic.AddUint64(&target.unfinishedJobs, ^uint64(0))
+	}
+}
+
+func readBatchFile(rootDataDirectory, location string) (batchFile, error) {
+	data, err := ioutil.ReadFile(rootDataDirectory + location + ".gz")
+	if err == nil {
+		return batchFile{location: location, encoding: "gzip", data: data}, nil
+	}
+	data, err = ioutil.ReadFile(rootDataDirectory + location)
+	return batchFile{location: location, data: data}, err
+}
+
+// sendBatch sends the files and records the outcome for each in results, with a nil error for
+// those successfully replicated.  it returns an error if the batch as a whole failed.
+func (target *ReplicationTarget) sendBatch(files []batchFile, results map[string]error) error {
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	for _, file := range files {
+		header := &tar.Header{
+			Name:     file.location,
+			Mode:     0644,
+			Size:     int64(len(file.data)),
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatPAX,
+		}
+		if file.encoding != "" {
+			header.PAXRecords = map[string]string{batchEncodingRecord: file.encoding}
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := archive.Write(file.data); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+
+	// the whole batch can simply be sent gzip-encoded, since the target decodes the stream
+	// before unpacking the entries
+	request := &buf
+	if target.compress {
+		request = &bytes.Buffer{}
+		compressor := gzip.NewWriter(request)
+		compressor.Write(buf.Bytes())
+		compressor.Close()
+	}
+
+	path := fmt.Sprintf("http://%s:%s%s", target.hostname, target.port, ReplicationBatchPath)
+	req, err := http.NewRequest("PUT", path, request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up request for %s: %s\n", path, err.Error())
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-tar")
+	if target.compress {
+		req.Header.Add("Content-Encoding", "gzip")
+	}
+
+	resp, err := target.client.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error replicating to %s: %s\n", path, err.Error())
+		return err
+
+	} else if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "HTTP error replicating to %s: %d %s\n", path, resp.StatusCode, body)
+		return &ReplicationError{message: fmt.Sprintf("HTTP error %d %s", resp.StatusCode, bytes.TrimSpace(body))}
+	}
+
+	// as for queueMissingFiles, make sure we only look at complete lines
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading batch results from %s: %s\n", path, err.Error())
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Split(ScanWholeLines)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) < 2 {
+			continue
+		}
+		status, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		if status == http.StatusCreated {
+			results[fields[1]] = nil
+		} else {
+			fmt.Fprintf(os.Stderr, "HTTP error replicating %s in batch to %s:%s: %s\n", fields[1], target.hostname, target.port, scanner.Text())
+			// as for Put, 422 means the target computed a different hash, so our copy is corrupt
+			results[fields[1]] = &ReplicationError{message: "HTTP error " + scanner.Text(), permanent: status == 422}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import "net/http"
+import "sync"
+import "time"
+
+// the right number of workers for a target depends on how far away and how busy it is, so rather
+// than running a fixed number, we adjust the number of active workers between a minimum and a
+// maximum as we go.  like TCP congestion control, we start small and double the number while
+// there are jobs waiting and the target keeps up, then add one at a time; if requests fail or
+// their latency rises well above the best we've seen, we halve it.
+//
+// bigger requests naturally take longer, so a change in the mix of file sizes we happen to be
+// sending would look like congestion if we compared them all to one baseline.  instead requests
+// are timed in size classes, each up to twice the size of the last, and each class has its own
+// baseline; sizes within a class differ by less than ReplicationConcurrencyLatencyFactor.
+const replicationSizeClasses = 10 // the smallest class is up to ReplicationBatchSize/2^9 bytes
+
+type replicationConcurrency struct {
+	mutex     sync.Mutex
+	changed   *sync.Cond
+	shares    ReplicationLaneShares
+	minimum   int
+	maximum   int
+	limit     int
+	active    [replicationLaneCount]int
+	slowStart bool
+	samples   [replicationSizeClasses]int
+	failures  int
+	latency   [replicationSizeClasses]time.Duration // total of the samples over this interval
+	baseline  [replicationSizeClasses]time.Duration
+	transport *replicationTransport
+}
+
+func newReplicationConcurrency(shares ReplicationLaneShares, minimum, maximum int, transport *replicationTransport) *replicationConcurrency {
+	if minimum > maximum {
+		minimum = maximum
+	}
+	concurrency := &replicationConcurrency{
+		shares:    shares,
+		minimum:   minimum,
+		maximum:   maximum,
+		slowStart: true,
+		transport: transport,
+	}
+	concurrency.changed = sync.NewCond(&concurrency.mutex)
+	concurrency.setLimit(minimum)
+	return concurrency
+}
+
+// must be called with the mutex held.
+func (concurrency *replicationConcurrency) setLimit(limit int) {
+	if limit < concurrency.minimum {
+		limit = concurrency.minimum
+	}
+	if limit > concurrency.maximum {
+		limit = concurrency.maximum
+	}
+	if limit == concurrency.limit {
+		return
+	}
+
+	concurrency.limit = limit
+	concurrency.active = [replicationLaneCount]int{}
+	for _, lane := range concurrency.shares.allocate(limit) {
+		concurrency.active[lane]++
+	}
+	concurrency.transport.resize(limit)
+	concurrency.changed.Broadcast()
+}
+
+// waitUntilActive blocks while the given worker is surplus to the current limit.  workers are
+// numbered within their lane, and the lowest-numbered workers in each lane are active.
+func (concurrency *replicationConcurrency) waitUntilActive(worker *replicationWorker) {
+	concurrency.mutex.Lock()
+	defer concurrency.mutex.Unlock()
+	for worker.laneIndex >= concurrency.active[worker.lane] {
+		concurrency.changed.Wait()
+	}
+}
+
+// succeeded notes that a request sending the given number of bytes to the target succeeded after
+// the given time.  the time taken to send files bigger than a batch is mostly spent transferring
+// them, so they aren't timed; their latency should be given as 0.  failures that aren't the
+// target's fault (such as our own copy of the file being missing or corrupt) should be counted as
+// successes.
+func (concurrency *replicationConcurrency) succeeded(size int64, latency time.Duration) {
+	concurrency.mutex.Lock()
+	defer concurrency.mutex.Unlock()
+	if latency > 0 {
+		class := sizeClass(size)
+		concurrency.samples[class]++
+		concurrency.latency[class] += latency
+	}
+}
+
+// sizeClass returns the size class that a request sending the given number of bytes is timed in.
+func sizeClass(size int64) int {
+	class := replicationSizeClasses - 1
+	for limit := int64(ReplicationBatchSize); class > 0 && size <= limit/2; limit /= 2 {
+		class--
+	}
+	return class
+}
+
+func (concurrency *replicationConcurrency) failed() {
+	concurrency.mutex.Lock()
+	defer concurrency.mutex.Unlock()
+	concurrency.failures++
+}
+
+// adjust is called every ReplicationConcurrencyInterval to change the limit based on the requests
+// made since the last call.  waiting is true if there are jobs waiting to be taken off the queue.
+func (concurrency *replicationConcurrency) adjust(waiting bool) {
+	concurrency.mutex.Lock()
+	defer concurrency.mutex.Unlock()
+
+	var average [replicationSizeClasses]time.Duration
+	congested := concurrency.failures > 0
+	for class := range average {
+		if concurrency.samples[class] > 0 {
+			average[class] = concurrency.latency[class] / time.Duration(concurrency.samples[class])
+		}
+		if concurrency.baseline[class] > 0 && average[class] > concurrency.baseline[class]*ReplicationConcurrencyLatencyFactor {
+			congested = true
+		}
+	}
+
+	if congested {
+		concurrency.setLimit(concurrency.limit / 2)
+		// as for TCP after a timeout, if we've been knocked all the way back down, ramp up quickly
+		// again once the target recovers
+		concurrency.slowStart = concurrency.limit == concurrency.minimum
+	} else if waiting && concurrency.slowStart {
+		concurrency.setLimit(concurrency.limit * 2)
+	} else if waiting {
+		concurrency.setLimit(concurrency.limit + 1)
+	}
+
+	// the baseline follows the best latency we see, but creeps up towards the current latency so
+	// that one unusually fast period doesn't make everything afterwards look congested
+	for class := range average {
+		if concurrency.failures == 0 && average[class] > 0 {
+			if concurrency.baseline[class] == 0 || average[class] < concurrency.baseline[class] {
+				concurrency.baseline[class] = average[class]
+			} else {
+				concurrency.baseline[class] += (average[class] - concurrency.baseline[class]) / ReplicationConcurrencyBaselineWeight
+			}
+		}
+	}
+
+	concurrency.samples = [replicationSizeClasses]int{}
+	concurrency.failures = 0
+	concurrency.latency = [replicationSizeClasses]time.Duration{}
+}
+
+func (concurrency *replicationConcurrency) workers() int {
+	concurrency.mutex.Lock()
+	defer concurrency.mutex.Unlock()
+	return concurrency.limit
+}
+
+func (concurrency *replicationConcurrency) laneWorkers(lane replicationLane) int {
+	concurrency.mutex.Lock()
+	defer concurrency.mutex.Unlock()
+	return concurrency.active[lane]
+}
+
+func (target *ReplicationTarget) recordOutcome(location string, latency time.Duration, err error) {
+	if err != nil && !isPermanentReplicationFailure(err) {
+		target.concurrency.failed()
+	} else if size, _ := replicationFileSize(target.rootDataDirectory, location); size > ReplicationBatchSize {
+		target.concurrency.succeeded(size, 0)
+	} else {
+		target.concurrency.succeeded(size, latency)
+	}
+}
+
+func (target *ReplicationTarget) adjustConcurrency() {
+	for range time.Tick(ReplicationConcurrencyInterval * time.Second) {
+		waiting := target.newFiles.length() > 0 || target.missingFiles.length() > 0 || target.largeFiles.length() > 0
+		target.concurrency.adjust(waiting && !target.isPaused())
+	}
+}
+
+// replicationTransport is an http.RoundTripper that keeps the number of idle connections to the
+// target in line with the number of workers.  http.Transport's settings can't be changed once
+// it's in use, so when the number changes substantially, we switch to a new one.
+type replicationTransport struct {
+	mutex     sync.Mutex
+	transport *http.Transport
+}
+
+func newReplicationTransport(transport *http.Transport) *replicationTransport {
+	return &replicationTransport{transport: transport}
+}
+
+func (transport *replicationTransport) current() *http.Transport {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return transport.transport
+}
+
+func (transport *replicationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return transport.current().RoundTrip(req)
+}
+
+func (transport *replicationTransport) resize(workers int) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	// switching transports means making new connections, so leave room to grow and only switch
+	// when the number of workers is well out of line.  the old transport's connections that are
+	// in use are closed after its IdleConnTimeout once they're returned.
+	connections := workers + 2
+	idle := transport.transport.MaxIdleConnsPerHost
+	if idle >= connections && idle <= connections*4 {
+		return
+	}
+
+	old := transport.transport
+	transport.transport = old.Clone()
+	transport.transport.MaxIdleConnsPerHost = connections * 2
+	old.CloseIdleConnections()
+}
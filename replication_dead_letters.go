@@ -0,0 +1,148 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "sync"
+import "time"
+
+// replication jobs that fail in a way that retrying can't fix - the file has vanished from our
+// disk, or the target rejected it because it doesn't match its location - are moved to a per-
+// target dead-letter list instead of occupying a worker forever.  the list is persisted so that
+// it survives restarts, and can be inspected, retried or discarded through the admin endpoint.
+type deadLetter struct {
+	Location string    `json:"location"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+type deadLetterList struct {
+	mutex    sync.Mutex
+	filename string
+	letters  map[string]deadLetter
+}
+
+func loadDeadLetters(filename string) *deadLetterList {
+	list := &deadLetterList{
+		filename: filename,
+		letters:  make(map[string]deadLetter),
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Couldn't read dead-letter list %s: %s\n", filename, err.Error())
+		}
+		return list
+	}
+
+	var letters []deadLetter
+	err = json.Unmarshal(data, &letters)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't parse dead-letter list %s: %s\n", filename, err.Error())
+		return list
+	}
+	for _, letter := range letters {
+		list.letters[letter.Location] = letter
+	}
+	return list
+}
+
+func (list *deadLetterList) add(location string, err error) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	list.letters[location] = deadLetter{Location: location, Error: err.Error(), Time: time.Now().UTC()}
+	list.save()
+}
+
+// remove takes the given locations off the list, or all locations if none are given, and returns
+// the locations actually removed.
+func (list *deadLetterList) remove(locations []string) []string {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	if len(locations) == 0 {
+		for location := range list.letters {
+			locations = append(locations, location)
+		}
+	}
+
+	removed := []string{}
+	for _, location := range locations {
+		if _, ok := list.letters[location]; ok {
+			delete(list.letters, location)
+			removed = append(removed, location)
+		}
+	}
+	if len(removed) > 0 {
+		list.save()
+	}
+	return removed
+}
+
+func (list *deadLetterList) list() []deadLetter {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	letters := make([]deadLetter, 0, len(list.letters))
+	for _, letter := range list.letters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Location < letters[j].Location })
+	return letters
+}
+
+func (list *deadLetterList) length() int {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	return len(list.letters)
+}
+
+// must be called with the mutex held.
+func (list *deadLetterList) save() {
+	letters := make([]deadLetter, 0, len(list.letters))
+	for _, letter := range list.letters {
+		letters = append(letters, letter)
+	}
+	data, err := json.Marshal(letters)
+	if err == nil {
+		err = writeFileAtomically(list.filename, data)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't save dead-letter list %s: %s\n", list.filename, err.Error())
+	}
+}
+
+// writeFileAtomically replaces the given file with the given contents, creating its directory if
+// necessary, so that readers (and restarts) see either the old or the new contents but never a
+// partially-written file.
+func writeFileAtomically(filename string, data []byte) error {
+	directory := filepath.Dir(filename)
+	err := os.MkdirAll(directory, DirectoryPermission)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(directory, "_upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name()) // fails harmlessly once renamed
+
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), filename)
+}
@@ -4,31 +4,78 @@ import "fmt"
 import "io"
 import "io/ioutil"
 import "os"
+import "path/filepath"
 import "net/http"
+import "strings"
+import "github.com/willbryant/verm/mimeext"
 
-func Put(client *http.Client, hostname, port, location, rootDataDirectory string) bool {
+// Put replicates the file at the given location.  if compress is true, uncompressed files of
+// compressible types are compressed on the wire, but stored uncompressed by the target.
+func Put(client *http.Client, hostname, port, location, rootDataDirectory string, compress bool) error {
 	encoding := "gzip"
 	input, err := os.Open(rootDataDirectory + location + ".gz")
 	if err != nil {
 		input, err = os.Open(rootDataDirectory + location)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Couldn't open file for replication: %s\n", err.Error())
-			return false
+			// if the file has gone, retrying won't bring it back
+			return &ReplicationError{message: err.Error(), permanent: os.IsNotExist(err)}
 		}
 		encoding = ""
 	}
 	defer input.Close()
 
+	stat, err := input.Stat()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't stat file for replication: %s\n", err.Error())
+		return &ReplicationError{message: err.Error()}
+	}
+
+	// if the file is large, see if the target already has part of it from a previous attempt
+	size := stat.Size()
+	offset := int64(0)
+	if size >= ReplicationResumableMinimumSize {
+		offset = partialUploadOffset(client, hostname, port, location)
+		if offset >= size {
+			offset = 0
+		}
+		_, err = input.Seek(offset, io.SeekStart)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't seek in file for replication: %s\n", err.Error())
+			return &ReplicationError{message: err.Error()}
+		}
+	}
+
+	var body io.Reader = input
+	transferEncoding := ""
+	if compress && encoding == "" && size-offset >= ReplicationCompressMinimumSize &&
+		compressibleType(mimeext.TypeByExtension(filepath.Ext(location))) {
+		compressed := compressForTransfer(input)
+		defer compressed.Close()
+		body = compressed
+		transferEncoding = "gzip"
+	}
+
 	path := fmt.Sprintf("http://%s:%s%s", hostname, port, location)
-	req, err := http.NewRequest("PUT", path, input)
+	req, err := http.NewRequest("PUT", path, body)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error setting up request for %s: %s\n", path, err.Error())
-		return false
+		return &ReplicationError{message: err.Error()}
+	}
+	if transferEncoding == "" {
+		req.ContentLength = size - offset
+	} else {
+		// we don't know how big it'll be until we've compressed it
+		req.ContentLength = -1
+		req.Header.Add(ReplicationTransferEncodingHeader, transferEncoding)
 	}
 	req.Header.Add("Content-Type", "application/octet-stream") // don't need to know the original type, just replicate the filename
 	if encoding != "" {
 		req.Header.Add("Content-Encoding", encoding)
 	}
+	if size >= ReplicationResumableMinimumSize {
+		req.Header.Add("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+	}
 
 	resp, err := client.Do(req)
 	if resp != nil && resp.Body != nil {
@@ -37,15 +84,30 @@ func Put(client *http.Client, hostname, port, location, rootDataDirectory string
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error replicating to %s: %s\n", path, err.Error())
-		return false
+		return &ReplicationError{message: err.Error()}
 
 	} else if resp.StatusCode != 201 {
 		body, _ := ioutil.ReadAll(resp.Body)
 		fmt.Fprintf(os.Stderr, "HTTP error replicating %s: %d %s\n", path, resp.StatusCode, body)
-		return false
+		// 422 means the target computed a different hash to the one in the location, so our copy is corrupt
+		return &ReplicationError{message: fmt.Sprintf("HTTP error %d %s", resp.StatusCode, strings.TrimSpace(string(body))), permanent: resp.StatusCode == 422}
 
 	} else {
 		io.Copy(ioutil.Discard, resp.Body)
-		return true
+		return nil
 	}
 }
+
+type ReplicationError struct {
+	message   string
+	permanent bool
+}
+
+func (e *ReplicationError) Error() string {
+	return e.message
+}
+
+func isPermanentReplicationFailure(err error) bool {
+	replicationError, ok := err.(*ReplicationError)
+	return ok && replicationError.permanent
+}
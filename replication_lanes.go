@@ -0,0 +1,143 @@
+package main
+
+import "fmt"
+import "time"
+
+// replication jobs are divided into lanes, so that a big resync backlog can't hold up freshly
+// uploaded files, and a few huge files can't tie up every worker.  each worker belongs to a lane
+// and takes jobs from that lane's queue first, only falling back to the other queues when its own
+// is empty; large files are only ever taken by the large file lane's workers.
+type replicationLane int
+
+const (
+	newFilesLane replicationLane = iota
+	missingFilesLane
+	largeFilesLane
+	replicationLaneCount
+)
+
+var replicationLaneNames = [replicationLaneCount]string{"new", "missing", "large"}
+
+func (lane replicationLane) String() string {
+	return replicationLaneNames[lane]
+}
+
+// ReplicationLaneShares gives the percentage of each target's workers to allocate to the missing
+// and large file lanes; the rest go to the new file lane.
+type ReplicationLaneShares struct {
+	Missing int
+	Large   int
+}
+
+func (shares ReplicationLaneShares) validate() error {
+	if shares.Missing < 0 || shares.Large < 0 || shares.Missing+shares.Large > 100 {
+		return fmt.Errorf("replication lane shares must be percentages adding up to no more than 100")
+	}
+	return nil
+}
+
+// allocate returns the lane for each of the given number of workers.  there is always at least
+// one large file worker, since no other workers will take large files.
+func (shares ReplicationLaneShares) allocate(workers int) []replicationLane {
+	large := workers * shares.Large / 100
+	if large < 1 {
+		large = 1
+	}
+	missing := workers * shares.Missing / 100
+	if missing > workers-large {
+		missing = workers - large
+	}
+
+	var lanes []replicationLane
+	for worker := 0; worker < workers; worker++ {
+		switch {
+		case worker < large:
+			lanes = append(lanes, largeFilesLane)
+		case worker < large+missing:
+			lanes = append(lanes, missingFilesLane)
+		default:
+			lanes = append(lanes, newFilesLane)
+		}
+	}
+	return lanes
+}
+
+// laneQueues returns the queues that workers in the given lane take jobs from, in priority order.
+func (target *ReplicationTarget) laneQueues(lane replicationLane) []*replicationQueue {
+	switch lane {
+	case missingFilesLane:
+		return []*replicationQueue{target.missingFiles, target.newFiles}
+	case largeFilesLane:
+		return []*replicationQueue{target.largeFiles, target.newFiles, target.missingFiles}
+	default:
+		return []*replicationQueue{target.newFiles, target.missingFiles}
+	}
+}
+
+func (target *ReplicationTarget) laneQueue(lane replicationLane) *replicationQueue {
+	return target.laneQueues(lane)[0]
+}
+
+// nextJob takes the next location off the queues for the given lane, waiting until there is one
+// or the timeout channel receives; a nil timeout waits indefinitely, including while we're paused.
+func (target *ReplicationTarget) nextJob(lane replicationLane, timeout <-chan time.Time) (string, bool) {
+	queues := target.laneQueues(lane)
+
+	// lanes with fewer queues leave the rest of these nil, and receiving from a nil channel
+	// (including a nil timeout) blocks forever
+	var own, second, third chan struct{}
+	own = queues[0].available
+	if len(queues) > 1 {
+		second = queues[1].available
+	}
+	if len(queues) > 2 {
+		third = queues[2].available
+	}
+
+	for {
+		// leave the jobs in the queue while we're paused
+		if target.isPaused() {
+			if timeout != nil {
+				return "", false
+			}
+			target.waitIfPaused()
+		}
+
+		for _, queue := range queues {
+			if location, ok := queue.tryPop(); ok {
+				// we may have been woken for a different queue to the one we took a job from, in
+				// which case we need to make sure someone else waiting on that queue gets woken
+				for _, other := range queues {
+					other.resignal()
+				}
+				return location, true
+			}
+		}
+
+		// if our own queue has been signalled, go straight back and take from it, so that we
+		// don't take a lower-priority job just because its queue happened to be selected first
+		select {
+		case <-own:
+			continue
+		default:
+		}
+
+		select {
+		case <-own:
+		case <-second:
+		case <-third:
+		case <-timeout:
+			return "", false
+		}
+	}
+}
+
+// enqueueLane returns the lane that the given location should be queued in, given that it would
+// otherwise go in the given lane.
+func (target *ReplicationTarget) enqueueLane(location string, lane replicationLane) replicationLane {
+	size, err := replicationFileSize(target.rootDataDirectory, location)
+	if err == nil && size >= ReplicationLargeFileSize {
+		return largeFilesLane
+	}
+	return lane
+}
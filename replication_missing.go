@@ -8,6 +8,7 @@ import "io"
 import "os"
 import "path"
 import "net/http"
+import "strings"
 
 func (server vermServer) serveMissing(w http.ResponseWriter, req *http.Request) error {
 	w.Header().Set("Content-Type", "text/plain")
@@ -18,6 +19,10 @@ func (server vermServer) serveMissing(w http.ResponseWriter, req *http.Request)
 		return err
 	}
 
+	// listing the files we have that the caller doesn't would let anyone enumerate our files, so
+	// we only do that for callers that give our admin token
+	reconciling := server.AdminToken != "" && server.adminAuthorized(req)
+
 	// we have to buffer the response because the http package kills the request input stream as soon as we start writing to the response stream
 	var buf bytes.Buffer
 
@@ -26,10 +31,10 @@ func (server vermServer) serveMissing(w http.ResponseWriter, req *http.Request)
 		w.Header().Set("Content-Type", "text/plain")
 
 		compressor := gzip.NewWriter(&buf)
-		server.listMissingFiles(input, compressor)
+		server.listMissingFiles(input, compressor, reconciling)
 		compressor.Close()
 	} else {
-		server.listMissingFiles(input, &buf)
+		server.listMissingFiles(input, &buf, reconciling)
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -41,14 +46,28 @@ func (server vermServer) serveMissing(w http.ResponseWriter, req *http.Request)
 	return nil
 }
 
-func (server vermServer) listMissingFiles(input io.Reader, output io.Writer) {
+func (server vermServer) listMissingFiles(input io.Reader, output io.Writer, reconciling bool) {
 	scanner := bufio.NewScanner(input)
 	scanner.Split(ScanWholeLines)
 
+	// in reconciliation mode, the caller also tells us about the directories it has, so that we
+	// can list the files we have that it doesn't; see replication_reconcile.go
+	mentioned := make(map[string]struct{})
+
 	for scanner.Scan() {
 		line := scanner.Text()
 
-		if !pathExists(server.RootDataDir, line) &&
+		if strings.HasSuffix(line, "/.") {
+			if reconciling {
+				server.listUnmentionedFiles(strings.TrimSuffix(line, "/."), mentioned, output)
+			}
+			mentioned = make(map[string]struct{})
+			continue
+		}
+		mentioned[line] = struct{}{}
+
+		if !strings.HasSuffix(line, "/") &&
+			!pathExists(server.RootDataDir, line) &&
 			!pathExists(server.RootDataDir, line+".gz") {
 			_, err := io.WriteString(output, line+"\r\n")
 			if err != nil {
@@ -0,0 +1,102 @@
+package main
+
+import "sync"
+
+// replicationQueue is a FIFO queue of locations to replicate.  we used to use plain channels, but
+// there's no way to see what's waiting in a channel, which makes it very hard to tell what's going
+// on when a queue backs up.
+type replicationQueue struct {
+	mutex     sync.Mutex
+	locations []string
+	limit     int
+	notFull   *sync.Cond
+	available chan struct{} // holds a value when there may be locations in the queue
+}
+
+func newReplicationQueue(limit int) *replicationQueue {
+	queue := &replicationQueue{
+		limit:     limit,
+		available: make(chan struct{}, 1),
+	}
+	queue.notFull = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+// tryPush adds the location to the queue if it isn't full, and returns false if it is.
+func (queue *replicationQueue) tryPush(location string) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if len(queue.locations) >= queue.limit {
+		return false
+	}
+	queue.locations = append(queue.locations, location)
+	queue.signal()
+	return true
+}
+
+// push adds the location to the queue, waiting until there's room if it's full.
+func (queue *replicationQueue) push(location string) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for len(queue.locations) >= queue.limit {
+		queue.notFull.Wait()
+	}
+	queue.locations = append(queue.locations, location)
+	queue.signal()
+}
+
+// tryPop takes the next location off the queue, and returns false if there isn't one.  to wait
+// for a location, receive from the available channel and try again.
+func (queue *replicationQueue) tryPop() (string, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if len(queue.locations) == 0 {
+		return "", false
+	}
+	location := queue.locations[0]
+	queue.locations[0] = "" // don't hold on to the string until the backing array is reallocated
+	queue.locations = queue.locations[1:]
+	queue.notFull.Signal()
+	if len(queue.locations) > 0 {
+		// there's more, so make sure someone else waiting gets woken too
+		queue.signal()
+	}
+	return location, true
+}
+
+// resignal makes sure someone waiting for the queue is woken if there's anything in it.
+func (queue *replicationQueue) resignal() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if len(queue.locations) > 0 {
+		queue.signal()
+	}
+}
+
+// must be called with the mutex held.
+func (queue *replicationQueue) signal() {
+	select {
+	case queue.available <- struct{}{}:
+	default:
+	}
+}
+
+func (queue *replicationQueue) length() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return len(queue.locations)
+}
+
+// sample returns up to the given number of locations from the front of the queue.
+func (queue *replicationQueue) sample(count int) []string {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if count > len(queue.locations) {
+		count = len(queue.locations)
+	}
+	return append([]string{}, queue.locations[:count]...)
+}
@@ -0,0 +1,155 @@
+package main
+
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "path"
+import "strings"
+import "time"
+
+// the /_missing exchange only tells us what the target lacks, so a target that doesn't replicate
+// back to us never sends us what we lack.  for targets given the reconcile option, we also tell
+// the target which directories we have, and it tells us which files it has in those directories
+// that we don't, which we then pull from it.
+//
+// when reconciling, the locations listed for each directory are followed by a line for each of
+// its subdirectories, ending in a slash, and then by a line giving the directory itself followed
+// by "/.".  in response to that line, the target lists each file it has directly in the directory
+// that wasn't mentioned, and every file it has under each subdirectory that wasn't mentioned,
+// prefixed by "+".  we never split a directory's lines over two requests, so the target only
+// needs to remember the lines since the last directory.
+//
+// the target would otherwise list all its files to anyone who asked, so we give our admin token,
+// and the target ignores the "/." lines unless it's the same as its own.
+
+func (server vermServer) listUnmentionedFiles(directory string, mentioned map[string]struct{}, output io.Writer) {
+	directory = strings.TrimSuffix(path.Clean("/"+directory), "/")
+	if server.isStatePath(directory) {
+		return
+	}
+
+	dir, err := os.Open(server.RootDataDir + directory)
+	if err != nil {
+		// if we don't have the directory, we don't have anything the caller doesn't
+		return
+	}
+	defer dir.Close()
+
+	for {
+		list, err := dir.Readdir(1000)
+
+		for _, fileinfo := range list {
+			if strings.HasPrefix(fileinfo.Name(), "_upload") {
+				continue
+			}
+			expanded := directory + "/" + fileinfo.Name()
+			if server.isStatePath(expanded) {
+				continue
+			}
+			if fileinfo.Mode().IsRegular() {
+				location := strings.TrimSuffix(expanded, ".gz")
+				if _, ok := mentioned[location]; !ok {
+					io.WriteString(output, "+"+location+"\r\n")
+				}
+			} else if fileinfo.Mode().IsDir() {
+				if _, ok := mentioned[expanded+"/"]; !ok {
+					// the caller doesn't have the directory at all, so list everything in it
+					server.listUnmentionedFiles(expanded, nil, output)
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Error scanning %s: %s\n", directory, err.Error())
+			return
+		}
+	}
+}
+
+// storeReplicatedFile stores a file pulled from another server, just as if it had been replicated
+// to us.
+func (server vermServer) storeReplicatedFile(location, encoding string, input io.Reader) (bool, error) {
+	newFile, err := server.uploadBatchEntry(location, encoding, input)
+	if err == nil && newFile {
+		syncDirectory(path.Dir(server.RootDataDir + location))
+	}
+	return newFile, err
+}
+
+// enqueuePull queues a file that the target has told us it has but we don't, or that we've found
+// to be corrupt.  if the queue is full, we don't wait; when reconciling, the file will be listed
+// again by the next resync.
+func (target *ReplicationTarget) enqueuePull(location string) {
+	target.pulls.tryPush(location)
+}
+
+func (target *ReplicationTarget) pullFromQueue() {
+	for {
+		target.waitIfPaused()
+		location, ok := target.pulls.tryPop()
+		if !ok {
+			<-target.pulls.available
+			continue
+		}
+
+		// we may have been sent the file since the target listed it, or it may have been listed
+		// twice if the target has both compressed and uncompressed copies
+		if pathExists(target.rootDataDirectory, location) || pathExists(target.rootDataDirectory, location+".gz") {
+			continue
+		}
+
+		for attempts := uint(1); ; attempts++ {
+			err := target.pullFile(location)
+			target.statistics.ReplicationPullAttempts.Add(1)
+			if err == nil {
+				break
+			}
+			target.statistics.ReplicationPullAttemptsFailed.Add(1)
+			fmt.Fprintf(os.Stderr, "Couldn't pull %s from %s:%s: %s\n", location, target.hostname, target.port, err.Error())
+			if isPermanentReplicationFailure(err) {
+				break
+			}
+			time.Sleep(backoffTime(attempts))
+		}
+	}
+}
+
+func (target *ReplicationTarget) pullFile(location string) error {
+	// forward=0 stops the target asking its own replicas if it no longer has the file
+	path := fmt.Sprintf("http://%s:%s%s?forward=0", target.hostname, target.port, location)
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return &ReplicationError{message: err.Error(), permanent: true}
+	}
+	req.Header.Add("Accept-Encoding", "gzip")
+
+	resp, err := target.client.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+
+	if err != nil {
+		return &ReplicationError{message: err.Error()}
+
+	} else if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		// if the target no longer has the file, retrying won't bring it back
+		return &ReplicationError{message: fmt.Sprintf("HTTP error %d %s", resp.StatusCode, strings.TrimSpace(string(body))), permanent: resp.StatusCode == 404}
+	}
+
+	_, err = target.store(location, resp.Header.Get("Content-Encoding"), resp.Body)
+	if err != nil {
+		switch err.(type) {
+		case *WrongLocationError, *ReservedPathError:
+			// the target's copy is corrupt, or the location isn't one we'd accept
+			return &ReplicationError{message: err.Error(), permanent: true}
+		default:
+			return &ReplicationError{message: err.Error()}
+		}
+	}
+	return nil
+}
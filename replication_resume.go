@@ -0,0 +1,119 @@
+package main
+
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "path"
+import "strconv"
+import "strings"
+import "time"
+
+// large files are replicated resumably.  the sender first asks the target how much of the file
+// it already has from a previous attempt (GET /_partial<location>, answered with an Upload-Offset
+// header), then sends only the remainder in a PUT to the location with a Content-Range header.
+// the target keeps the data received by any PUT with a Content-Range header in a partial file
+// named after the location if the connection drops.  the content hash is still checked over the
+// whole file when the upload is finished.  partial files are removed when the file is stored,
+// however it arrives, or once they're old enough that the sender has evidently given up.
+
+func parseUploadContentRange(value string) (int64, error) {
+	var first, last, size int64
+	_, err := fmt.Sscanf(value, "bytes %d-%d/%d", &first, &last, &size)
+	if err != nil || first < 0 || last < first || last != size-1 {
+		return 0, errors.New("invalid Content-Range " + value)
+	}
+	return first, nil
+}
+
+func partialUploadName(root, directory, location string) string {
+	// the location is the directory followed by the hash-derived subdirectory and filename
+	return root + directory + "/_upload_partial" + strings.Replace(location[len(directory):], "/", "_", -1)
+}
+
+// expirePartialUpload removes the given file if it's a partial upload too old for the sender to
+// still be trying to resume it.  resyncs call this for each partial upload they come across.
+func expirePartialUpload(filename string, fileinfo os.FileInfo) {
+	if fileinfo.Mode().IsRegular() && strings.HasPrefix(fileinfo.Name(), "_upload_partial") &&
+		time.Since(fileinfo.ModTime()) > ReplicationPartialUploadExpiry*time.Second {
+		os.Remove(filename)
+	}
+}
+
+func claimPartialUpload(directory, partialName, location string, offset int64) (*os.File, error) {
+	// rename the partial file to a tempfile name of our own, so that if another attempt to resume
+	// the same file comes in concurrently, only one of us gets it
+	tempFile, err := ioutil.TempFile(directory, "_upload")
+	if err != nil {
+		return nil, err
+	}
+	tempFile.Close()
+
+	err = os.Rename(partialName, tempFile.Name())
+	if err != nil {
+		os.Remove(tempFile.Name())
+		if os.IsNotExist(err) {
+			return nil, &UploadOffsetError{location: location, offset: offset}
+		}
+		return nil, err
+	}
+
+	name := tempFile.Name()
+	tempFile, err = os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+
+	size, err := tempFile.Seek(0, io.SeekEnd)
+	if err == nil && size != offset {
+		// the sender has a different idea of what we have, so start again from scratch
+		err = &UploadOffsetError{location: location, offset: offset}
+	}
+	if err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return nil, err
+	}
+
+	return tempFile, nil
+}
+
+func (server vermServer) servePartialUpload(w http.ResponseWriter, req *http.Request) {
+	location := path.Clean(strings.TrimPrefix(req.URL.Path, ReplicationPartialUploadPath))
+	directory, err := locationDirectory(location)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	stat, err := os.Stat(partialUploadName(server.RootDataDir, directory, location))
+	if err != nil || !stat.Mode().IsRegular() {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(stat.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func partialUploadOffset(client *http.Client, hostname, port, location string) int64 {
+	path := fmt.Sprintf("http://%s:%s%s%s", hostname, port, ReplicationPartialUploadPath, location)
+	resp, err := client.Head(path)
+	if err != nil {
+		// we'll find out about any real problem when we try to send the file
+		return 0
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return 0
+	}
+	return offset
+}
@@ -11,8 +11,8 @@ import "net/http"
 import "strings"
 import "time"
 
-func (target *ReplicationTarget) enumerateFiles(locations chan<- string) {
-	target.enumerateSubdirectory("", locations)
+func (target *ReplicationTarget) enumerateFiles(directory string, locations chan<- string) {
+	target.enumerateSubdirectory(directory, locations)
 	close(locations)
 }
 
@@ -22,13 +22,18 @@ func (target *ReplicationTarget) enumerateSubdirectory(directory string, locatio
 		return err
 	}
 	defer dir.Close()
+	target.resync.scannedDirectory()
+
+	// we finish listing the files in each directory before going into its subdirectories, so
+	// that when reconciling, all the lines for the directory can be sent together
+	var subdirectories []string
 
 	for {
 		list, err := dir.Readdir(1000)
 
 		if len(list) == 0 {
 			if err == io.EOF {
-				return nil
+				break
 			} else if err != nil {
 				fmt.Fprintf(os.Stderr, "Error scanning %s: %s\n", directory, err.Error())
 				return err
@@ -36,21 +41,46 @@ func (target *ReplicationTarget) enumerateSubdirectory(directory string, locatio
 		}
 
 		for _, fileinfo := range list {
-			if len(fileinfo.Name()) < 7 || fileinfo.Name()[0:7] != "_upload" {
+			if len(fileinfo.Name()) >= 7 && fileinfo.Name()[0:7] == "_upload" {
+				// we're looking at every file anyway, so this is a good time to tidy up
+				expirePartialUpload(target.rootDataDirectory+directory+"/"+fileinfo.Name(), fileinfo)
+			} else {
 				expanded := fmt.Sprintf("%s%c%s", directory, os.PathSeparator, fileinfo.Name())
+				if target.rootDataDirectory+expanded == target.stateDirectory {
+					// our own state, not part of the file store
+					continue
+				}
 				if fileinfo.Mode().IsRegular() {
+					target.resync.scannedFile()
 					locations <- strings.TrimSuffix(expanded, ".gz")
 				} else if fileinfo.Mode().IsDir() {
-					target.enumerateSubdirectory(expanded, locations)
+					subdirectories = append(subdirectories, expanded)
+					if target.reconcile {
+						locations <- expanded + "/"
+					}
 				} else {
 					fmt.Fprintf(os.Stderr, "Ignoring irregular directory entry %s\n", expanded)
 				}
 			}
 		}
 	}
+
+	if target.reconcile {
+		// see replication_reconcile.go
+		locations <- directory + "/."
+	}
+	dir.Close() // no need to keep it open while we scan the subdirectories
+
+	for _, subdirectory := range subdirectories {
+		target.enumerateSubdirectory(subdirectory, locations)
+	}
+	return nil
 }
 
-func (target *ReplicationTarget) sendFileLists(locations <-chan string) {
+// sendFileLists sends the locations to the target to check which are missing, and queues those
+// that are.  resyncing is true when the locations come from a resync rather than from files
+// replicated to us, so that we can keep track of the resync's progress.
+func (target *ReplicationTarget) sendFileLists(locations <-chan string, resyncing bool) {
 	for {
 		location := <-locations
 
@@ -62,17 +92,25 @@ func (target *ReplicationTarget) sendFileLists(locations <-chan string) {
 		var buf bytes.Buffer
 		compressor := gzip.NewWriter(&buf)
 		batchTimeout := time.After(time.Second * ReplicationMissingFilesBatchTime)
+		due := false
 
 		for location != "" {
 			// the request bodies are simply a list of all the locations, one per line.
 			io.WriteString(compressor, location)
 			io.WriteString(compressor, "\r\n")
 
+			// when reconciling, the lines for each directory have to be sent in the same request,
+			// so we can only stop at the end of a directory
+			boundary := !resyncing || !target.reconcile || strings.HasSuffix(location, "/.")
+
 			// the compressor flushes output through to the backing buffer periodically.  if this
 			// pushes its size up to the target batch size, send a request.  note that we have to
 			// use a byte buffer rather than streaming straight to the HTTP request, because when
 			// requests fail we have to retry the same list.
 			if buf.Len() > ReplicationMissingFilesBatchSize {
+				due = true
+			}
+			if due && boundary {
 				break
 			}
 
@@ -80,36 +118,46 @@ func (target *ReplicationTarget) sendFileLists(locations <-chan string) {
 			case location = <-locations:
 
 			case <-batchTimeout:
-				location = ""
+				due = true
+				batchTimeout = nil
+				if boundary {
+					location = ""
+				}
 			}
 		}
 
 		// send the list of locations
 		compressor.Close() // Flush isn't enough, we have to close and make a new compressor to get the gzip stream terminated
-		target.sendFileListUntilSuccessful(buf.Bytes())
+		missing := target.sendFileListUntilSuccessful(buf.Bytes())
+		if resyncing {
+			target.resync.foundMissing(missing)
+		}
 	}
 }
 
-func (target *ReplicationTarget) sendFileListUntilSuccessful(data []byte) {
+func (target *ReplicationTarget) sendFileListUntilSuccessful(data []byte) int {
 	input := bytes.NewReader(data)
 	for attempts := uint(1); ; attempts++ {
 		input.Seek(0, 0)
-		if target.sendFileList(input) {
-			break
+		if missing, ok := target.sendFileList(input); ok {
+			return missing
 		}
 		time.Sleep(backoffTime(attempts))
 	}
 }
 
-func (target *ReplicationTarget) sendFileList(input io.Reader) bool {
+func (target *ReplicationTarget) sendFileList(input io.Reader) (int, bool) {
 	path := fmt.Sprintf("http://%s:%s%s", target.hostname, target.port, ReplicationMissingFilesPath)
 	req, err := http.NewRequest("PUT", path, input)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error setting up request to %s: %s\n", path, err.Error())
-		return false
+		return 0, false
 	}
 	req.Header.Add("Content-Type", "text/plain")
 	req.Header.Add("Content-Encoding", "gzip")
+	if target.reconcile {
+		req.Header.Add("Authorization", "Bearer "+target.adminToken)
+	}
 
 	resp, err := target.client.Do(req)
 	if resp != nil && resp.Body != nil {
@@ -118,19 +166,18 @@ func (target *ReplicationTarget) sendFileList(input io.Reader) bool {
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error requesting %s: %s\n", path, err.Error())
-		return false
+		return 0, false
 
 	} else if resp.StatusCode != 200 {
 		body, _ := ioutil.ReadAll(resp.Body)
 		fmt.Fprintf(os.Stderr, "Couldn't see missing files on %s:%s (%d): %s\n", target.hostname, target.port, resp.StatusCode, body)
-		return false
+		return 0, false
 	}
 
-	target.queueMissingFiles(resp)
-	return true
+	return target.queueMissingFiles(resp), true
 }
 
-func (target *ReplicationTarget) queueMissingFiles(resp *http.Response) {
+func (target *ReplicationTarget) queueMissingFiles(resp *http.Response) int {
 	// copy the response to check that it isn't terminated prematurely.  we'd rather directly use
 	// bufio.NewScanner on the resp.Body, but scanner.Scan() will return half-lines if the input
 	// is closed early, which can happen if the other end goes away halfway through sending the
@@ -145,18 +192,26 @@ func (target *ReplicationTarget) queueMissingFiles(resp *http.Response) {
 	input, err := EncodingDecoder(encoding, bytes.NewReader(buf))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Couldn't see missing files on %s:%s: %s\n", target.hostname, target.port, err)
-		return
+		return 0
 	}
 
 	scanner := bufio.NewScanner(input)
 	scanner.Split(ScanWholeLines)
 
+	missing := 0
 	for scanner.Scan() {
 		location := scanner.Text()
+		if strings.HasPrefix(location, "+") {
+			// the target has this file but we don't; see replication_reconcile.go
+			target.enqueuePull(location[1:])
+			continue
+		}
 		target.enqueueMissingFile(location)
+		missing++
 	}
 
 	if scanner.Err() != nil {
 		fmt.Fprintf(os.Stderr, "Error reading missing file list from %s:%s: %s\n", target.hostname, target.port, scanner.Err().Error())
 	}
+	return missing
 }
@@ -0,0 +1,83 @@
+package main
+
+import "sync"
+import "time"
+
+// resyncProgress records what the current (or last) resync to a target has done, so that we can
+// tell whether it is still scanning and when a newly-added replica has actually caught up.
+type resyncProgress struct {
+	mutex        sync.Mutex
+	running      bool
+	started      time.Time
+	directories  uint64
+	files        uint64
+	missing      uint64
+	lastDuration time.Duration
+	nextSchedule time.Time
+}
+
+type resyncStatus struct {
+	Running      bool
+	Started      time.Time
+	Directories  uint64
+	Files        uint64
+	Missing      uint64
+	LastDuration time.Duration
+	NextSchedule time.Time
+}
+
+func (progress *resyncProgress) start() {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.running = true
+	progress.started = time.Now()
+	progress.directories = 0
+	progress.files = 0
+	progress.missing = 0
+}
+
+func (progress *resyncProgress) finish() resyncStatus {
+	progress.mutex.Lock()
+	progress.running = false
+	progress.lastDuration = time.Since(progress.started)
+	progress.mutex.Unlock()
+	return progress.status()
+}
+
+func (progress *resyncProgress) scannedDirectory() {
+	progress.mutex.Lock()
+	progress.directories++
+	progress.mutex.Unlock()
+}
+
+func (progress *resyncProgress) scannedFile() {
+	progress.mutex.Lock()
+	progress.files++
+	progress.mutex.Unlock()
+}
+
+func (progress *resyncProgress) foundMissing(count int) {
+	progress.mutex.Lock()
+	progress.missing += uint64(count)
+	progress.mutex.Unlock()
+}
+
+func (progress *resyncProgress) scheduled(next time.Time) {
+	progress.mutex.Lock()
+	progress.nextSchedule = next
+	progress.mutex.Unlock()
+}
+
+func (progress *resyncProgress) status() resyncStatus {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	return resyncStatus{
+		Running:      progress.running,
+		Started:      progress.started,
+		Directories:  progress.directories,
+		Files:        progress.files,
+		Missing:      progress.missing,
+		LastDuration: progress.lastDuration,
+		NextSchedule: progress.nextSchedule,
+	}
+}
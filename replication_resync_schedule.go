@@ -0,0 +1,102 @@
+package main
+
+import "errors"
+import "fmt"
+import "math/rand"
+import "os"
+import "time"
+
+// a replica that silently loses files (say its disk is replaced, or it is restored from an old
+// backup) won't get them back until we resync, so resyncs can be scheduled to run periodically,
+// either every so often or once a day at some point in a quiet window.  the times are jittered so
+// that a cluster of servers started together doesn't scan in lockstep.
+type ResyncSchedule struct {
+	interval     time.Duration
+	window       bool
+	windowStart  time.Duration // since midnight, local time
+	windowLength time.Duration
+}
+
+func (schedule *ResyncSchedule) SetInterval(value string) error {
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if interval < 0 {
+		return errors.New("resync interval can't be negative")
+	}
+	schedule.interval = interval
+	return nil
+}
+
+func (schedule *ResyncSchedule) SetWindow(value string) error {
+	var startHour, startMinute, endHour, endMinute int
+	_, err := fmt.Sscanf(value, "%d:%d-%d:%d", &startHour, &startMinute, &endHour, &endMinute)
+	if err != nil || !validTimeOfDay(startHour, startMinute) || !validTimeOfDay(endHour, endMinute) {
+		return errors.New("resync window must be given as HH:MM-HH:MM")
+	}
+
+	start := time.Duration(startHour)*time.Hour + time.Duration(startMinute)*time.Minute
+	end := time.Duration(endHour)*time.Hour + time.Duration(endMinute)*time.Minute
+	if end <= start {
+		// the window spans midnight
+		end += 24 * time.Hour
+	}
+
+	schedule.window = true
+	schedule.windowStart = start
+	schedule.windowLength = end - start
+	return nil
+}
+
+func validTimeOfDay(hour, minute int) bool {
+	return hour >= 0 && hour < 24 && minute >= 0 && minute < 60
+}
+
+func (schedule ResyncSchedule) enabled() bool {
+	return schedule.window || schedule.interval > 0
+}
+
+// next returns the time after now that the next scheduled resync should start.  if a window is
+// set, that is a random time in the next window to start after now (so if we're started part-way
+// through a window, we wait until the next day's - the startup resync has that covered), otherwise
+// it's the interval plus or minus up to ResyncScheduleJitter percent.
+func (schedule ResyncSchedule) next(now time.Time, random *rand.Rand) time.Time {
+	if schedule.window {
+		year, month, day := now.Date()
+		start := time.Date(year, month, day, 0, 0, 0, 0, now.Location()).Add(schedule.windowStart)
+		if !start.After(now) {
+			start = start.AddDate(0, 0, 1)
+		}
+		return start.Add(time.Duration(random.Int63n(int64(schedule.windowLength))))
+	}
+
+	jitter := int64(schedule.interval) * ResyncScheduleJitter / 100
+	if jitter <= 0 {
+		return now.Add(schedule.interval)
+	}
+	return now.Add(schedule.interval + time.Duration(random.Int63n(2*jitter)-jitter))
+}
+
+func (target *ReplicationTarget) resyncOnSchedule() {
+	// the global source is unseeded, so every server would pick the same times
+	random := rand.New(rand.NewSource(time.Now().UnixNano() + int64(os.Getpid())))
+
+	for {
+		next := target.schedule.next(time.Now(), random)
+		target.resync.scheduled(next)
+		time.Sleep(time.Until(next))
+
+		if target.resync.status().Running {
+			if !target.quiet {
+				fmt.Fprintf(os.Stdout, "Skipping scheduled resync to %s:%s as the last resync is still running\n", target.hostname, target.port)
+			}
+			continue
+		}
+
+		if !target.quiet {
+			fmt.Fprintf(os.Stdout, "Starting scheduled resync to %s:%s\n", target.hostname, target.port)
+		}
+		target.enqueueResync()
+	}
+}
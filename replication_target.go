@@ -1,34 +1,103 @@
 package main
 
+import "fmt"
+import "io"
 import "net"
 import "net/http"
+import "net/url"
+import "os"
+import "strconv"
+import "sync"
 import "sync/atomic"
 import "time"
 
 type ReplicationTarget struct {
 	hostname          string
 	port              string
-	newFiles          chan string
+	locality          string
+	newFiles          *replicationQueue
 	replicatedFiles   chan string
-	missingFiles      chan string
+	missingFiles      *replicationQueue
+	largeFiles        *replicationQueue
+	pulls             *replicationQueue
+	reconcile         bool
+	adminToken        string
+	compress          bool
+	store             func(location, encoding string, input io.Reader) (bool, error)
+	laneShares        ReplicationLaneShares
+	minWorkers        int
+	concurrency       *replicationConcurrency
 	needToResync      chan struct{}
+	subtreeResyncs    chan string
 	rootDataDirectory string
+	stateDirectory    string
 	statistics        *LogStatistics
 	unfinishedJobs    uint64
+	workers           []*replicationWorker
 	client            *http.Client
+	health            *replicaHealth
+	deadLetters       *deadLetterList
+	resync            *resyncProgress
+	schedule          ResyncSchedule
+	scheduleSet       bool // if false, the schedule given to ReplicationTargets applies
+	quiet             bool
+	pauseMutex        sync.Mutex
+	paused            bool
+	unpaused          *sync.Cond
+	latency           int64 // nanoseconds; accessed atomically
 }
 
-func NewReplicationTarget(hostname, port string) ReplicationTarget {
-	return ReplicationTarget{
+func NewReplicationTarget(hostname, port string) *ReplicationTarget {
+	target := &ReplicationTarget{
 		hostname: hostname,
 		port:     port,
+		health:   &replicaHealth{},
+		resync:   &resyncProgress{},
 	}
+	target.unpaused = sync.NewCond(&target.pauseMutex)
+	return target
 }
 
-func (target *ReplicationTarget) Start(rootDataDirectory string, statistics *LogStatistics, workers int) {
+func (target *ReplicationTarget) SetOptions(query string) error {
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	for name, values := range options {
+		value := values[len(values)-1]
+		switch name {
+		case "locality":
+			target.locality = value
+
+		case "reconcile":
+			target.reconcile, err = strconv.ParseBool(value)
+
+		case "compress":
+			target.compress, err = strconv.ParseBool(value)
+
+		case "resync-interval":
+			err = target.schedule.SetInterval(value)
+			target.scheduleSet = true
+
+		case "resync-window":
+			err = target.schedule.SetWindow(value)
+			target.scheduleSet = true
+
+		default:
+			return fmt.Errorf("unknown option %s for replication target %s:%s", name, target.hostname, target.port)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s option for replication target %s:%s: %s", name, target.hostname, target.port, err.Error())
+		}
+	}
+	return nil
+}
+
+func (target *ReplicationTarget) Start(rootDataDirectory, stateDirectory string, statistics *LogStatistics, workers int, quiet bool) {
 	transport := &http.Transport{
-		// increase MaxIdleConnsPerHost:
+		// increase MaxIdleConnsPerHost (this is adjusted later to follow the number of active workers):
 		MaxIdleConnsPerHost: workers + 2,
+		IdleConnTimeout:     ReplicationIdleConnectionTimeout * time.Second,
 
 		// otherwise defaults (as per DefaultTransport):
 		Proxy: http.ProxyFromEnvironment,
@@ -40,32 +109,50 @@ func (target *ReplicationTarget) Start(rootDataDirectory string, statistics *Log
 		ResponseHeaderTimeout: ReplicationNetworkTimeout * time.Second,
 	}
 
+	replicationTransport := newReplicationTransport(transport)
 	target.client = &http.Client{
 		Timeout:   ReplicationRequestTimeout * time.Second,
-		Transport: transport,
+		Transport: replicationTransport,
 	}
+	target.concurrency = newReplicationConcurrency(target.laneShares, target.minWorkers, workers, replicationTransport)
 
 	target.rootDataDirectory = rootDataDirectory
+	target.stateDirectory = stateDirectory
 	target.statistics = statistics
-	target.newFiles = make(chan string, ReplicationQueueSize-ReplicationMissingQueueSize-workers)
+	target.quiet = quiet
+	target.deadLetters = loadDeadLetters(fmt.Sprintf("%s%s/%s_%s.json", stateDirectory, ReplicationDeadLettersSubdirectory, target.hostname, target.port))
+	target.newFiles = newReplicationQueue(ReplicationQueueSize - ReplicationMissingQueueSize - workers)
 	target.replicatedFiles = make(chan string, ReplicationQueueSize-ReplicationMissingQueueSize-workers)
-	target.missingFiles = make(chan string, ReplicationMissingQueueSize)
+	target.missingFiles = newReplicationQueue(ReplicationMissingQueueSize)
+	target.largeFiles = newReplicationQueue(ReplicationLargeQueueSize)
+	target.pulls = newReplicationQueue(ReplicationPullQueueSize)
 	target.needToResync = make(chan struct{}, 1)
+	target.subtreeResyncs = make(chan string, ResyncSubtreeQueueSize)
 
-	go target.sendFileLists(target.replicatedFiles)
+	go target.sendFileLists(target.replicatedFiles, false)
 	go target.resyncFromQueue()
-	for worker := 1; worker < workers; worker++ {
-		go target.replicateFromQueue()
+	if target.schedule.enabled() {
+		go target.resyncOnSchedule()
+	}
+	var laneWorkers [replicationLaneCount]int
+	for index, lane := range target.laneShares.allocate(workers) {
+		worker := &replicationWorker{id: index + 1, lane: lane, laneIndex: laneWorkers[lane]}
+		laneWorkers[lane]++
+		target.workers = append(target.workers, worker)
+		go target.replicateFromQueue(worker)
+	}
+	go target.adjustConcurrency()
+	// pulls are needed for reconciling, and for replacing files we find to be corrupt
+	for worker := 0; worker < ReplicationPullWorkers; worker++ {
+		go target.pullFromQueue()
 	}
 }
 
 func (target *ReplicationTarget) enqueueNewFile(location string) {
 	// try and add to the queue of files to be sent without any further checking
-	select {
-	case target.newFiles <- location:
+	if target.laneQueue(target.enqueueLane(location, newFilesLane)).tryPush(location) {
 		atomic.AddUint64(&target.unfinishedJobs, 1)
-
-	default:
+	} else {
 		// queue is full, request a resync so the file eventually gets sent
 		target.enqueueResync()
 	}
@@ -86,37 +173,96 @@ func (target *ReplicationTarget) enqueueReplicatedFile(location string) {
 
 func (target *ReplicationTarget) enqueueMissingFile(location string) {
 	// it would be silly to resync if the queue is full in this case, so we just wait
-	target.missingFiles <- location
+	target.laneQueue(target.enqueueLane(location, missingFilesLane)).push(location)
 	atomic.AddUint64(&target.unfinishedJobs, 1)
 }
 
-func (target *ReplicationTarget) replicateFromQueue() {
+func (target *ReplicationTarget) replicateFromQueue(worker *replicationWorker) {
 	for {
-		var location string
-		select {
-		case location = <-target.newFiles:
-		case location = <-target.missingFiles:
+		target.concurrency.waitUntilActive(worker)
+		location, _ := target.nextJob(worker.lane, nil)
+
+		if !target.smallFile(location) {
+			target.replicateFile(worker, location)
+			atomic.AddUint64(&target.unfinishedJobs, ^uint64(0))
+			continue
 		}
-		target.replicateFile(location)
-		atomic.AddUint64(&target.unfinishedJobs, ^uint64(0))
+
+		// small files are sent in batches where possible, to cut down on per-request overhead
+		worker.started(location, 0)
+		batch, others := target.collectBatch(worker.lane, location)
+		if len(batch) > 1 {
+			target.replicateBatch(worker, batch)
+		} else {
+			others = append(batch, others...)
+		}
+		for _, location := range others {
+			target.replicateFile(worker, location)
+			atomic.AddUint64(&target.unfinishedJobs, ^uint64(0))
+		}
+		worker.finished()
 	}
 }
 
-func (target *ReplicationTarget) replicateFile(location string) {
+func (target *ReplicationTarget) replicateFile(worker *replicationWorker, location string) {
+	worker.started(location, 0)
+	defer worker.finished()
+
 	for attempts := uint(1); ; attempts++ {
-		ok := Put(target.client, target.hostname, target.port, location, target.rootDataDirectory)
+		target.waitIfPaused()
+		worker.attempted(attempts)
+		started := time.Now()
+		err := Put(target.client, target.hostname, target.port, location, target.rootDataDirectory, target.compress)
+		target.recordOutcome(location, time.Since(started), err)
 
-		if ok {
+		if err == nil {
 			target.statistics.ReplicationPushAttempts.Add(1)
 			break
+		} else if isPermanentReplicationFailure(err) {
+			target.statistics.ReplicationPushAttempts.Add(1)
+			target.statistics.ReplicationPushAttemptsFailed.Add(1)
+			target.deadLetters.add(location, err)
+			worker.failed(err, 0)
+			break
 		} else {
 			target.statistics.ReplicationPushAttempts.Add(1)
 			target.statistics.ReplicationPushAttemptsFailed.Add(1)
-			time.Sleep(backoffTime(attempts))
+			backoff := backoffTime(attempts)
+			worker.failed(err, backoff)
+			time.Sleep(backoff)
 		}
 	}
 }
 
+// pause stops the workers taking further jobs off the queue (or retrying failed jobs) until
+// resume is called.  jobs already in progress are allowed to finish.
+func (target *ReplicationTarget) pause() {
+	target.pauseMutex.Lock()
+	target.paused = true
+	target.pauseMutex.Unlock()
+}
+
+func (target *ReplicationTarget) resume() {
+	target.pauseMutex.Lock()
+	target.paused = false
+	target.unpaused.Broadcast()
+	target.pauseMutex.Unlock()
+}
+
+func (target *ReplicationTarget) isPaused() bool {
+	target.pauseMutex.Lock()
+	defer target.pauseMutex.Unlock()
+	return target.paused
+}
+
+func (target *ReplicationTarget) waitIfPaused() {
+	target.pauseMutex.Lock()
+	for target.paused {
+		target.unpaused.Wait()
+	}
+	target.pauseMutex.Unlock()
+}
+
 func (target *ReplicationTarget) queueLength() int {
 	// we used to simply use len() on the channels, but that makes jobs disappear off the count and
 	// reappear later if they fail, so we count them as they're added and finished now
@@ -137,15 +283,50 @@ func (target *ReplicationTarget) enqueueResync() {
 	}
 }
 
+// enqueueSubtreeResync queues a resync of just the given directory and its subdirectories.
+// unlike full resyncs, these aren't idempotent, so they're queued individually; it returns false
+// if there are too many already queued.
+func (target *ReplicationTarget) enqueueSubtreeResync(directory string) bool {
+	select {
+	case target.subtreeResyncs <- directory:
+		return true
+
+	default:
+		return false
+	}
+}
+
 func (target *ReplicationTarget) resyncFromQueue() {
-	for range target.needToResync {
+	for {
+		directory := ""
+		select {
+		case <-target.needToResync:
+		case directory = <-target.subtreeResyncs:
+		}
+
 		// our thread scans the directory and pushes the filenames found to a channel which is
 		// listened to by a second routine, which posts batches of those filenames over to the
 		// target and gets back lists of missing files - which it then pushes onto the regular
 		// replication job queue.  this provides overall flow control; if the replication jobs
 		// don't make it through, there's no point finding more and more files not replicated.
+		target.resync.start()
 		locations := make(chan string, 1000) // arbitrary buffer to give some concurrency
-		go target.sendFileLists(locations)
-		target.enumerateFiles(locations)
+		done := make(chan struct{})
+		go func() {
+			target.sendFileLists(locations, true)
+			close(done)
+		}()
+		target.enumerateFiles(directory, locations)
+		<-done
+
+		status := target.resync.finish()
+		if !target.quiet {
+			scope := ""
+			if directory != "" {
+				scope = " of " + directory
+			}
+			fmt.Fprintf(os.Stdout, "Resync%s to %s:%s finished in %s: scanned %d directories and %d files, %d missing\n",
+				scope, target.hostname, target.port, status.LastDuration, status.Directories, status.Files, status.Missing)
+		}
 	}
 }
@@ -1,10 +1,18 @@
 package main
 
 import "fmt"
+import "io"
 import "strings"
 
 type ReplicationTargets struct {
-	targets []*ReplicationTarget
+	targets        []*ReplicationTarget
+	Locality       string
+	ResyncSchedule ResyncSchedule // for targets that don't have their own
+	LaneShares     ReplicationLaneShares
+	MinWorkers     int
+	AdminToken     string
+	Store          func(location, encoding string, input io.Reader) (bool, error) // used to store files pulled from targets when reconciling
+	recentlyQueued *recentLocations                                               // set if the data watcher needs to know which files we've queued ourselves
 }
 
 func parseTarget(value string) (string, string) {
@@ -19,25 +27,61 @@ func parseTarget(value string) (string, string) {
 
 func (targets *ReplicationTargets) Set(value string) error {
 	for _, s := range strings.Split(value, ",") {
-		hostname, port := parseTarget(s)
+		address, options := s, ""
+		if index := strings.Index(s, "?"); index >= 0 {
+			address, options = s[:index], s[index+1:]
+		}
+		hostname, port := parseTarget(address)
 		target := NewReplicationTarget(hostname, port)
-		targets.targets = append(targets.targets, &target)
+		err := target.SetOptions(options)
+		if err != nil {
+			return err
+		}
+		targets.targets = append(targets.targets, target)
 	}
 	return nil
 }
 
 func (targets *ReplicationTargets) String() string {
 	// shown as the default in the help text
-	return "<hostname> or <hostname>:<port>"
+	return "<hostname> or <hostname>:<port>, optionally followed by options such as ?locality=<datacentre or zone>&resync-interval=<interval>&reconcile=1&compress=1"
 }
 
-func (targets *ReplicationTargets) Start(rootDataDirectory string, statistics *LogStatistics, workers int) {
+func (targets *ReplicationTargets) Start(rootDataDirectory, stateDirectory string, statistics *LogStatistics, workers int, quiet bool) {
 	for _, target := range targets.targets {
-		target.Start(rootDataDirectory, statistics, workers)
+		if !target.scheduleSet {
+			target.schedule = targets.ResyncSchedule
+		}
+		target.laneShares = targets.LaneShares
+		target.minWorkers = targets.MinWorkers
+		target.adminToken = targets.AdminToken
+		target.store = targets.Store
+		target.Start(rootDataDirectory, stateDirectory, statistics, workers, quiet)
 	}
 }
 
+func (targets *ReplicationTargets) reconciling() bool {
+	for _, target := range targets.targets {
+		if target.reconcile {
+			return true
+		}
+	}
+	return false
+}
+
+func (targets *ReplicationTargets) find(name string) *ReplicationTarget {
+	for _, target := range targets.targets {
+		if target.hostname+":"+target.port == name {
+			return target
+		}
+	}
+	return nil
+}
+
 func (targets *ReplicationTargets) EnqueueFile(location string, replicating bool) {
+	if targets.recentlyQueued != nil {
+		targets.recentlyQueued.add(location)
+	}
 	for _, target := range targets.targets {
 		if replicating {
 			target.enqueueReplicatedFile(location)
@@ -47,6 +91,14 @@ func (targets *ReplicationTargets) EnqueueFile(location string, replicating bool
 	}
 }
 
+// EnqueuePull asks each target for a copy of a file that we should have but don't.  the first
+// good copy received is kept, and the other targets' pulls find we have it and do nothing.
+func (targets *ReplicationTargets) EnqueuePull(location string) {
+	for _, target := range targets.targets {
+		target.enqueuePull(location)
+	}
+}
+
 func (targets *ReplicationTargets) EnqueueResync() {
 	for _, target := range targets.targets {
 		target.enqueueResync()
@@ -57,14 +109,98 @@ func (targets *ReplicationTargets) StatisticsString() string {
 	if len(targets.targets) <= 0 {
 		return ""
 	}
-	metricName := "verm_replication_queue_length"
-	result := fmt.Sprintf("# HELP %s Number of files in the queue to be replicated to each configured replica.\n", metricName)
-	result = fmt.Sprintf("%s# TYPE %s gauge\n", result, metricName)
+	result := targets.targetStatistics("verm_replication_queue_length", "gauge", "Number of files in the queue to be replicated to each configured replica.", func(target *ReplicationTarget) string {
+		return fmt.Sprintf("%d", target.queueLength())
+	})
+	result += targets.laneStatistics("verm_replication_lane_jobs", "gauge", "Number of files waiting in each lane of the queue to be replicated to each configured replica, not including those being sent.", func(target *ReplicationTarget, lane replicationLane) int {
+		return target.laneQueue(lane).length()
+	})
+	result += targets.targetStatistics("verm_replication_workers", "gauge", "Number of workers currently replicating files to each configured replica; adjusted automatically based on the replica's response times and errors.", func(target *ReplicationTarget) string {
+		return fmt.Sprintf("%d", target.concurrency.workers())
+	})
+	result += targets.laneStatistics("verm_replication_lane_workers", "gauge", "Number of workers replicating files in each lane to each configured replica.", func(target *ReplicationTarget, lane replicationLane) int {
+		return target.concurrency.laneWorkers(lane)
+	})
+	result += targets.targetStatistics("verm_replica_up", "gauge", "Whether each configured replica is currently considered up for read forwarding.", func(target *ReplicationTarget) string {
+		up, _ := target.health.state()
+		if up {
+			return "1"
+		}
+		return "0"
+	})
+	result += targets.targetStatistics("verm_replica_consecutive_failures", "gauge", "Number of consecutive failed read forwarding requests to each configured replica.", func(target *ReplicationTarget) string {
+		_, failures := target.health.state()
+		return fmt.Sprintf("%d", failures)
+	})
+	result += targets.targetStatistics("verm_replica_latency_seconds", "gauge", "Moving average of the response time of read forwarding requests to each configured replica.", func(target *ReplicationTarget) string {
+		return fmt.Sprintf("%f", target.averageLatency().Seconds())
+	})
+	result += targets.targetStatistics("verm_replication_dead_letters", "gauge", "Number of files that permanently failed to replicate to each configured replica.", func(target *ReplicationTarget) string {
+		return fmt.Sprintf("%d", target.deadLetters.length())
+	})
+	result += targets.targetStatistics("verm_replication_paused", "gauge", "Whether replication to each configured replica has been paused through the admin API.", func(target *ReplicationTarget) string {
+		if target.isPaused() {
+			return "1"
+		}
+		return "0"
+	})
+	result += targets.targetStatistics("verm_replication_resync_running", "gauge", "Whether a resync to each configured replica is currently running.", func(target *ReplicationTarget) string {
+		if target.resync.status().Running {
+			return "1"
+		}
+		return "0"
+	})
+	result += targets.targetStatistics("verm_replication_resync_next_scheduled_time_seconds", "gauge", "Time the next scheduled resync to each configured replica is due, in seconds since the epoch; 0 if none are scheduled.", func(target *ReplicationTarget) string {
+		status := target.resync.status()
+		if status.NextSchedule.IsZero() {
+			return "0"
+		}
+		return fmt.Sprintf("%d", status.NextSchedule.Unix())
+	})
+	result += targets.targetStatistics("verm_replication_resync_start_time_seconds", "gauge", "Start time of the current or last resync to each configured replica, in seconds since the epoch.", func(target *ReplicationTarget) string {
+		status := target.resync.status()
+		if status.Started.IsZero() {
+			return "0"
+		}
+		return fmt.Sprintf("%d", status.Started.Unix())
+	})
+	result += targets.targetStatistics("verm_replication_resync_directories_scanned", "gauge", "Number of directories scanned by the current or last resync to each configured replica.", func(target *ReplicationTarget) string {
+		return fmt.Sprintf("%d", target.resync.status().Directories)
+	})
+	result += targets.targetStatistics("verm_replication_resync_files_scanned", "gauge", "Number of files scanned by the current or last resync to each configured replica.", func(target *ReplicationTarget) string {
+		return fmt.Sprintf("%d", target.resync.status().Files)
+	})
+	result += targets.targetStatistics("verm_replication_resync_missing_files", "gauge", "Number of files the current or last resync found missing on each configured replica.", func(target *ReplicationTarget) string {
+		return fmt.Sprintf("%d", target.resync.status().Missing)
+	})
+	result += targets.targetStatistics("verm_replication_resync_last_duration_seconds", "gauge", "Duration of the last completed resync to each configured replica.", func(target *ReplicationTarget) string {
+		return fmt.Sprintf("%f", target.resync.status().LastDuration.Seconds())
+	})
+	return result
+}
+
+func (targets *ReplicationTargets) laneStatistics(metricName, metricType, description string, value func(*ReplicationTarget, replicationLane) int) string {
+	result := fmt.Sprintf("# HELP %s %s\n", metricName, description)
+	result = fmt.Sprintf("%s# TYPE %s %s\n", result, metricName, metricType)
+	for _, target := range targets.targets {
+		for lane := replicationLane(0); lane < replicationLaneCount; lane++ {
+			result = fmt.Sprintf(
+				"%s%s{target=\"%s:%s\",lane=\"%s\"} %d\n",
+				result, metricName,
+				target.hostname, target.port, lane, value(target, lane))
+		}
+	}
+	return result
+}
+
+func (targets *ReplicationTargets) targetStatistics(metricName, metricType, description string, value func(*ReplicationTarget) string) string {
+	result := fmt.Sprintf("# HELP %s %s\n", metricName, description)
+	result = fmt.Sprintf("%s# TYPE %s %s\n", result, metricName, metricType)
 	for _, target := range targets.targets {
 		result = fmt.Sprintf(
-			"%s%s{target=\"%s:%s\"} %d\n",
+			"%s%s{target=\"%s:%s\"} %s\n",
 			result, metricName,
-			target.hostname, target.port, target.queueLength())
+			target.hostname, target.port, value(target))
 	}
 	return result
 }
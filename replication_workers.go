@@ -0,0 +1,112 @@
+package main
+
+import "sync"
+import "time"
+
+// replicationWorker keeps track of what one of a target's workers is doing, so that we can see
+// what's stuck when a queue backs up.
+type replicationWorker struct {
+	mutex         sync.Mutex
+	id            int
+	lane          replicationLane
+	laneIndex     int // workers are numbered within each lane, and the lowest numbered are active
+	location      string
+	batchSize     int
+	attempts      uint
+	backoff       time.Duration
+	lastError     string
+	lastErrorTime time.Time
+}
+
+type replicationWorkerStatus struct {
+	Worker         int        `json:"worker"`
+	Lane           string     `json:"lane"`
+	Location       string     `json:"location,omitempty"`
+	BatchSize      int        `json:"batch_size,omitempty"`
+	Attempts       uint       `json:"attempts,omitempty"`
+	BackoffSeconds float64    `json:"backoff_seconds,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorTime  *time.Time `json:"last_error_time,omitempty"`
+}
+
+// started records that the worker is replicating the given location, or batch of locations
+// starting with it.
+func (worker *replicationWorker) started(location string, batchSize int) {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	worker.location = location
+	worker.batchSize = batchSize
+	worker.attempts = 0
+	worker.backoff = 0
+}
+
+func (worker *replicationWorker) attempted(attempts uint) {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	worker.attempts = attempts
+	worker.backoff = 0
+}
+
+func (worker *replicationWorker) failed(err error, backoff time.Duration) {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	worker.backoff = backoff
+	worker.lastError = err.Error()
+	worker.lastErrorTime = time.Now().UTC()
+}
+
+func (worker *replicationWorker) finished() {
+	worker.started("", 0)
+}
+
+func (worker *replicationWorker) status() replicationWorkerStatus {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	status := replicationWorkerStatus{
+		Worker:         worker.id,
+		Lane:           worker.lane.String(),
+		Location:       worker.location,
+		BatchSize:      worker.batchSize,
+		Attempts:       worker.attempts,
+		BackoffSeconds: worker.backoff.Seconds(),
+		LastError:      worker.lastError,
+	}
+	if !worker.lastErrorTime.IsZero() {
+		lastErrorTime := worker.lastErrorTime
+		status.LastErrorTime = &lastErrorTime
+	}
+	return status
+}
+
+type replicationQueueStatus struct {
+	QueueLength   int                       `json:"queue_length"`
+	Paused        bool                      `json:"paused"`
+	NewFiles      []string                  `json:"new_files"`
+	MissingFiles  []string                  `json:"missing_files"`
+	LargeFiles    []string                  `json:"large_files"`
+	Workers       []replicationWorkerStatus `json:"workers"`
+	LastError     string                    `json:"last_error,omitempty"`
+	LastErrorTime *time.Time                `json:"last_error_time,omitempty"`
+}
+
+// queueStatus returns the first sampleSize locations waiting in each queue, what each worker is
+// doing, and the most recent error any of them got.
+func (target *ReplicationTarget) queueStatus(sampleSize int) replicationQueueStatus {
+	status := replicationQueueStatus{
+		QueueLength:  target.queueLength(),
+		Paused:       target.isPaused(),
+		NewFiles:     target.newFiles.sample(sampleSize),
+		MissingFiles: target.missingFiles.sample(sampleSize),
+		LargeFiles:   target.largeFiles.sample(sampleSize),
+		Workers:      []replicationWorkerStatus{},
+	}
+	for _, worker := range target.workers {
+		workerStatus := worker.status()
+		status.Workers = append(status.Workers, workerStatus)
+		if workerStatus.LastErrorTime != nil && (status.LastErrorTime == nil || workerStatus.LastErrorTime.After(*status.LastErrorTime)) {
+			status.LastError = workerStatus.LastError
+			status.LastErrorTime = workerStatus.LastErrorTime
+		}
+	}
+	return status
+}
@@ -0,0 +1,172 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "strings"
+import "time"
+
+// the scrubber rehashes every stored file in turn in the background, to find files whose contents
+// have rotted since they were stored, and replaces them with good copies from the replicas.  it
+// reads slowly so as not to compete with serving files, so a pass over a large data directory can
+// take days; its progress is saved in the state directory so that after a restart it carries on
+// from where it was rather than starting the pass again.
+type scrubProgress struct {
+	Running           bool      `json:"running"`
+	Location          string    `json:"location"` // the last location checked in the current pass
+	Started           time.Time `json:"started"`
+	LastPassCompleted time.Time `json:"last_pass_completed"`
+}
+
+type scrubber struct {
+	server   vermServer
+	filename string
+	interval time.Duration
+	rate     int64 // bytes per second
+	progress scrubProgress
+	saved    time.Time
+}
+
+// StartScrubber starts scrubbing the data directory, starting a pass every interval.
+func StartScrubber(server vermServer, interval time.Duration, rate int64) {
+	scrubber := &scrubber{
+		server:   server,
+		filename: server.StateDir + ScrubProgressFilename,
+		interval: interval,
+		rate:     rate,
+	}
+	scrubber.load()
+	if !scrubber.progress.LastPassCompleted.IsZero() {
+		server.Statistics.ScrubLastPassCompleted.Set(scrubber.progress.LastPassCompleted.Unix())
+	}
+	go scrubber.scrubOnSchedule()
+}
+
+func (scrubber *scrubber) load() {
+	data, err := ioutil.ReadFile(scrubber.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Couldn't read scrub progress %s: %s\n", scrubber.filename, err.Error())
+		}
+		return
+	}
+
+	err = json.Unmarshal(data, &scrubber.progress)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't parse scrub progress %s: %s\n", scrubber.filename, err.Error())
+		scrubber.progress = scrubProgress{}
+	}
+}
+
+func (scrubber *scrubber) save() {
+	scrubber.saved = time.Now()
+	data, err := json.Marshal(scrubber.progress)
+	if err == nil {
+		err = writeFileAtomically(scrubber.filename, data)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't save scrub progress %s: %s\n", scrubber.filename, err.Error())
+	}
+}
+
+func (scrubber *scrubber) scrubOnSchedule() {
+	for {
+		if !scrubber.progress.Running {
+			// each pass starts an interval after the last one started, so that each file is checked
+			// about once per interval, unless the passes take longer than that
+			time.Sleep(time.Until(scrubber.progress.Started.Add(scrubber.interval)))
+			scrubber.progress = scrubProgress{
+				Running:           true,
+				Started:           time.Now().UTC(),
+				LastPassCompleted: scrubber.progress.LastPassCompleted,
+			}
+			scrubber.save()
+		}
+
+		err := scrubber.scrub()
+		if err != nil {
+			// carry on from where we got to once whatever's wrong has hopefully been fixed
+			fmt.Fprintf(os.Stderr, "Error scrubbing files: %s\n", err.Error())
+			scrubber.save()
+			time.Sleep(ScrubRetryDelay * time.Second)
+			continue
+		}
+
+		scrubber.progress.Running = false
+		scrubber.progress.Location = ""
+		scrubber.progress.LastPassCompleted = time.Now().UTC()
+		scrubber.server.Statistics.ScrubLastPassCompleted.Set(scrubber.progress.LastPassCompleted.Unix())
+		scrubber.save()
+		if !scrubber.server.Quiet {
+			fmt.Fprintf(os.Stdout, "Scrubbed all files in %s\n", time.Since(scrubber.progress.Started).Round(time.Second))
+		}
+	}
+}
+
+func (scrubber *scrubber) scrub() error {
+	server := scrubber.server
+	resume := scrubber.progress.Location
+
+	// skip everything up to and including the last location we checked, apart from the directories
+	// it's in, which listLocations lists in order
+	skip := func(path string) bool {
+		return server.isStatePath(path) ||
+			(resume != "" && compareLocations(strings.TrimSuffix(path, ".gz"), resume) <= 0 && !strings.HasPrefix(resume, path+"/"))
+	}
+
+	return listLocations(server.RootDataDir, "", skip, func(location string) error {
+		scrubber.check(location)
+		scrubber.progress.Location = location
+		if time.Since(scrubber.saved) >= ScrubProgressSaveInterval*time.Second {
+			scrubber.save()
+		}
+		return nil
+	})
+}
+
+func (scrubber *scrubber) check(location string) {
+	server := scrubber.server
+
+	// files that weren't named after their contents by Verm can't be checked
+	if locationDigest(location) == nil {
+		return
+	}
+
+	file, encoding, err := openStoredFile(server.RootDataDir, location)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't scrub %s: %s\n", location, err.Error())
+		return
+	}
+	defer file.Close()
+
+	err = verifyStoredContents(location, encoding, &throttledReader{input: file, rate: scrubber.rate})
+	server.Statistics.ScrubFilesChecked.Add(1)
+	if err == nil {
+		return
+	} else if !corruptContentsError(err) {
+		fmt.Fprintf(os.Stderr, "Couldn't scrub %s: %s\n", location, err.Error())
+		return
+	}
+
+	server.Statistics.ScrubCorruptFiles.Add(1)
+	server.quarantineFile(location, encoding == "gzip")
+}
+
+// throttledReader limits the rate at which the scrubber reads files.
+type throttledReader struct {
+	input io.Reader
+	rate  int64 // bytes per second
+}
+
+func (reader *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > ScrubReadSize {
+		p = p[:ScrubReadSize]
+	}
+	n, err := reader.input.Read(p)
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(reader.rate))
+	return n, err
+}
@@ -1,5 +1,6 @@
 package main
 
+import "encoding/base64"
 import "fmt"
 import "io"
 import "net"
@@ -7,6 +8,7 @@ import "net/http"
 import "os"
 import "path"
 import "path/filepath"
+import "strings"
 import "github.com/willbryant/verm/mimeext"
 
 type vermServer struct {
@@ -15,19 +17,31 @@ type vermServer struct {
 	Closed      uint32
 	RootDataDir string
 	RootHttpDir http.Dir
+	StateDir    string
+	AdminToken  string
 	Targets     *ReplicationTargets
 	Statistics  *LogStatistics
+	GzipIndexer *GzipIndexer
+	Renditions  *RenditionMaker // nil if renditions aren't enabled
 	Quiet       bool
+
+	CompressResponsesOver int64 // bytes; 0 if disabled
+	CacheMaxAge           int   // seconds; 0 if we don't send Cache-Control
+	VerifyReads           bool
+	RememberFilenames     bool
 }
 
-func VermServer(listener net.Listener, rootDataDirectory string, replicationTargets *ReplicationTargets, statistics *LogStatistics, quiet bool) vermServer {
+func VermServer(listener net.Listener, rootDataDirectory, stateDirectory, adminToken string, replicationTargets *ReplicationTargets, statistics *LogStatistics, quiet bool) vermServer {
 	return vermServer{
 		Listener:    listener,
 		Tracker:     NewConnectionTracker(),
 		RootDataDir: rootDataDirectory,
 		RootHttpDir: http.Dir(rootDataDirectory),
+		StateDir:    stateDirectory,
+		AdminToken:  adminToken,
 		Targets:     replicationTargets,
 		Statistics:  statistics,
+		GzipIndexer: NewGzipIndexer(stateDirectory+GzipIndexSubdirectory, quiet),
 		Quiet:       quiet,
 	}
 }
@@ -49,6 +63,19 @@ func (server vermServer) serveFile(w http.ResponseWriter, req *http.Request) {
 	// deal with '/..' etc.
 	path := path.Clean(req.URL.Path)
 
+	// our own state files aren't part of the file store, even if they're under the root directory
+	if server.isStatePath(path) {
+		server.Statistics.GetRequests.Add(1)
+		server.Statistics.GetRequestsNotFound.Add(1)
+		http.NotFound(w, req)
+		return
+	}
+
+	if archive, member, ok := splitArchiveMemberPath(path); ok {
+		server.serveArchiveMember(w, req, archive, member)
+		return
+	}
+
 	// try and open the file
 	file, stat, err := server.openFile(path)
 	storedCompressed := false
@@ -70,41 +97,124 @@ func (server vermServer) serveFile(w http.ResponseWriter, req *http.Request) {
 	defer file.Close()
 	defer server.Statistics.GetRequests.Add(1)
 
-	// if the client supplied cache-checking header, test them
-	// because verm files are immutable, we can use the path as a constant etag for the file
-	if checkLastModified(w, req, stat.ModTime()) || checkETag(w, req, path) {
-		// the client is up-to-date
-		w.Header().Del("Content-Length")
-		w.WriteHeader(http.StatusNotModified)
-	} else {
-		w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
-		w.Header().Set("ETag", path)
-
-		// infer the content-type from the filename extension
-		contentType := mimeext.TypeByExtension(filepath.Ext(path))
-		if contentType == "" {
-			// we must set a header to avoid go sniffing the content and setting the header for us, which leads to
-			// problems like gzip content-encoded data getting also described as having application/x-gzip content type
-			w.Header().Set("Content-Type", "application/octet-stream")
-		} else {
-			w.Header().Set("Content-Type", contentType)
+	if server.Renditions != nil && renditionRequested(req) {
+		encoding := ""
+		if storedCompressed {
+			encoding = "gzip"
 		}
+		server.serveRendition(w, req, path, file, stat, encoding)
+		return
+	}
 
-		// send the file
-		if !storedCompressed {
-			serveContent(w, req, stat.Size(), file)
+	// infer the content-type from the filename extension
+	contentType := mimeext.TypeByExtension(filepath.Ext(path))
 
-		} else if gzipAccepted(req) {
-			w.Header().Set("Content-Encoding", "gzip")
-			serveContent(w, req, stat.Size(), file)
+	// the response depends on the client's Accept-Encoding if we might decompress or compress the file for it
+	compressible := !storedCompressed && server.CompressResponsesOver > 0 && stat.Size() >= server.CompressResponsesOver && compressibleType(contentType)
+	if storedCompressed || compressible {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
 
-		} else if req.Method == "HEAD" {
-			w.WriteHeader(http.StatusOK)
+	// work out how we're going to send the file, since each encoding has its own ETag
+	compressOnTheFly := compressible && gzipPreferred(req) && req.Header.Get("Range") == ""
+	sendCompressed := compressOnTheFly || (storedCompressed && gzipAccepted(req))
+	encoding := ""
+	if sendCompressed {
+		encoding = "gzip"
+	}
+
+	w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", entityTag(path, stat, encoding))
+	if server.CacheMaxAge > 0 {
+		// verm files never change, so caches never need to revalidate them
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", server.CacheMaxAge))
+	}
 
-		} else {
-			unpackAndServeContent(w, req, file)
+	defaultFilename := ""
+	if server.RememberFilenames {
+		defaultFilename = server.rememberedFilename(path)
+	}
+	setContentDisposition(w, req, defaultFilename)
+
+	// if the client supplied cache-checking or other conditional headers, test them
+	if checkPreconditions(w, req, stat.ModTime()) {
+		return
+	}
+
+	// we know the hash of the uncompressed contents from the location, so we can give it to the
+	// client to check, except when sending it compressed
+	if digest := digestHeader(path); digest != "" && !sendCompressed {
+		w.Header().Set("Repr-Digest", digest)
+		if req.Header.Get("Range") == "" {
+			w.Header().Set("Content-Digest", digest)
 		}
 	}
+
+	if contentType == "" {
+		// we must set a header to avoid go sniffing the content and setting the header for us, which leads to
+		// problems like gzip content-encoded data getting also described as having application/x-gzip content type
+		w.Header().Set("Content-Type", "application/octet-stream")
+	} else {
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	// if asked to, check the file against its hash as we send it; we can't when sending byte ranges
+	var content io.ReadSeeker = file
+	var verifier *readVerifier
+	if server.VerifyReads && req.Method == "GET" && req.Header.Get("Range") == "" && locationDigest(path) != nil {
+		verifier = newReadVerifier(file, path, stat.Size(), storedCompressed)
+		defer verifier.Close()
+		content = verifier
+	}
+
+	// send the file
+	if compressOnTheFly {
+		compressAndServeContent(w, req, content)
+
+	} else if !storedCompressed {
+		serveContent(w, req, stat.Size(), content)
+
+	} else if sendCompressed {
+		w.Header().Set("Content-Encoding", "gzip")
+		serveContent(w, req, stat.Size(), content)
+
+	} else {
+		server.unpackAndServeContent(w, req, path, content, stat.Size())
+	}
+
+	if verifier != nil && verifier.Corrupt() {
+		// we held back the end of the file, but the client has already had the headers, so all we can do is
+		// drop the connection so it knows the response was incomplete; next time we'll fetch it from a replica
+		server.quarantineFile(path, storedCompressed)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// digestHeader returns the value for a Repr-Digest header (RFC 9530) for the uncompressed contents
+// of the file at the given location, or "" if we don't know the hash.
+func digestHeader(location string) string {
+	digest := locationDigest(location)
+	if digest == nil {
+		return ""
+	}
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(digest) + ":"
+}
+
+// entityTag returns the ETag for the file at the given path when sent with the given
+// content-coding.  files are named after the hash of their contents, which identifies them; for
+// files that weren't named by Verm, we use the size and modification time as other webservers do.
+// the tag is only strong for the uncompressed contents, since the compressed bytes depend on how
+// and where the file was compressed, so they can differ between servers and between requests;
+// a weak tag stops clients combining byte ranges of different compressed streams using If-Range.
+func entityTag(path string, stat os.FileInfo, encoding string) string {
+	tag := locationHash(path)
+	if tag == "" {
+		tag = fmt.Sprintf("%x-%x", stat.ModTime().Unix(), stat.Size())
+	}
+	if encoding != "" {
+		return `W/"` + tag + "-" + encoding + `"`
+	}
+	return `"` + tag + `"`
 }
 
 func (server vermServer) openFile(path string) (http.File, os.FileInfo, error) {
@@ -126,6 +236,11 @@ func (server vermServer) openFile(path string) (http.File, os.FileInfo, error) {
 	return file, stat, nil
 }
 
+func (server vermServer) isStatePath(path string) bool {
+	filename := server.RootDataDir + path
+	return filename == server.StateDir || strings.HasPrefix(filename, server.StateDir+"/")
+}
+
 type IsDirectoryError struct {
 	path string
 }
@@ -139,6 +254,8 @@ func (server vermServer) serveHTTPGetOrHead(w http.ResponseWriter, req *http.Req
 		server.serveRoot(w, req)
 	} else if req.URL.Path == "/_statistics" {
 		server.serveStatistics(w, req, server.Targets)
+	} else if strings.HasPrefix(req.URL.Path, ReplicationPartialUploadPath+"/") {
+		server.servePartialUpload(w, req)
 	} else {
 		server.serveFile(w, req)
 	}
@@ -149,10 +266,15 @@ func (server vermServer) serveHTTPPost(w http.ResponseWriter, req *http.Request)
 
 	location, newFile, err := server.UploadFile(w, req, false)
 	if err != nil {
-		if server.Active() {
-			fmt.Fprintf(os.Stderr, "Error serving POST to %s: %s\n", req.URL.Path, err.Error())
+		switch err.(type) {
+		case *ReservedPathError:
+			http.Error(w, err.Error(), 403)
+		default:
+			if server.Active() {
+				fmt.Fprintf(os.Stderr, "Error serving POST to %s: %s\n", req.URL.Path, err.Error())
+			}
+			http.Error(w, err.Error(), 500)
 		}
-		http.Error(w, err.Error(), 500)
 		return
 	}
 	if newFile {
@@ -163,6 +285,9 @@ func (server vermServer) serveHTTPPost(w http.ResponseWriter, req *http.Request)
 	if req.FormValue("redirect") == "1" {
 		w.WriteHeader(http.StatusSeeOther)
 	} else {
+		if digest := digestHeader(location); digest != "" {
+			w.Header().Set("Repr-Digest", digest)
+		}
 		w.WriteHeader(http.StatusCreated)
 	}
 }
@@ -176,12 +301,21 @@ func (server vermServer) serveHTTPPut(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	if req.URL.Path == ReplicationBatchPath {
+		server.serveBatch(w, req)
+		return
+	}
+
 	location, newFile, err := server.UploadFile(w, req, true)
 	if err != nil {
 		server.Statistics.PutRequestsFailed.Add(1)
 		switch err.(type) {
 		case *WrongLocationError:
 			http.Error(w, err.Error(), 422)
+		case *ReservedPathError:
+			http.Error(w, err.Error(), 403)
+		case *UploadOffsetError:
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
 		default:
 			if server.Active() {
 				fmt.Fprintf(os.Stderr, "Error serving PUT to %s: %s\n", req.URL.Path, err.Error())
@@ -195,6 +329,9 @@ func (server vermServer) serveHTTPPut(w http.ResponseWriter, req *http.Request)
 	}
 
 	w.Header().Set("Location", location)
+	if digest := digestHeader(location); digest != "" {
+		w.Header().Set("Repr-Digest", digest)
+	}
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -205,7 +342,11 @@ func (server vermServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// we need to keep track of the response code and count the bytes so we can log them below
 	logger := &responseLogger{w: w, req: req}
 
-	if req.Method == "GET" || req.Method == "HEAD" {
+	if strings.HasPrefix(req.URL.Path, AdminPathPrefix) {
+		server.serveAdmin(logger, req)
+	} else if req.URL.Path == BundlePath {
+		server.serveBundle(logger, req)
+	} else if req.Method == "GET" || req.Method == "HEAD" {
 		server.serveHTTPGetOrHead(logger, req)
 	} else if req.Method == "POST" {
 		server.serveHTTPPost(logger, req)
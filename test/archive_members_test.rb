@@ -0,0 +1,52 @@
+require File.expand_path(File.join(File.dirname(__FILE__), 'test_helper'))
+
+class ArchiveMembersTest < Verm::TestCase
+  def tar_data(files)
+    io = StringIO.new("".force_encoding("binary"))
+    Gem::Package::TarWriter.new(io) do |tar|
+      files.each do |name, data|
+        tar.add_file_simple(name, 0644, data.bytesize) {|f| f.write(data)}
+      end
+    end
+    io.string
+  end
+
+  def test_serves_members_of_zip_archives
+    location = post_file :path => '/archives', :file => 'archive.zip', :type => 'application/zip', :expected_extension => 'zip'
+
+    get :path => "#{location}/!/docs/readme.txt",
+        :expected_content_type => 'text/plain',
+        :expected_content => File.read(fixture_file_path('compressible_file'), :mode => 'rb')[0, 20000]
+
+    binary = File.read(fixture_file_path('binary_file'), :mode => 'rb')
+    get :path => "#{location}/!/binary_file",
+        :expected_content_type => 'application/octet-stream',
+        :expected_content => binary
+
+    # members stored uncompressed can be served in ranges
+    get :path => "#{location}/!/binary_file",
+        :headers => {'Range' => 'bytes=10-19'},
+        :expected_response_code => 206,
+        :expected_content => binary[10, 10]
+
+    get :path => "#{location}/!/docs/missing.txt",
+        :expected_response_code => 404
+  end
+
+  def test_serves_members_of_tar_archives_stored_compressed
+    data = tar_data('site/index.html' => '<html>hello</html>', 'site/notes.txt' => 'some notes')
+    location = post_file :path => '/archives', :data => gzip(data), :type => 'application/x-tar', :encoding => 'gzip',
+                         :expected_extension => 'tar', :expected_extension_suffix => 'gz'
+
+    get :path => "#{location}/!/site/notes.txt",
+        :expected_content_type => 'text/plain',
+        :expected_content => 'some notes'
+
+    get :path => "#{location}/!/site/index.html",
+        :expected_content_type => 'text/html',
+        :expected_content => '<html>hello</html>'
+
+    get :path => "#{location}/!/site",
+        :expected_response_code => 404
+  end
+end
@@ -0,0 +1,61 @@
+require File.expand_path(File.join(File.dirname(__FILE__), 'test_helper'))
+
+class BundleTest < Verm::TestCase
+  def bundle_path(params)
+    "/_bundle?#{URI.encode_www_form(params)}"
+  end
+
+  def tar_entries(data)
+    entries = {}
+    Gem::Package::TarReader.new(StringIO.new(data)) do |tar|
+      tar.each {|entry| entries[entry.full_name] = entry.read || ""}
+    end
+    entries
+  end
+
+  def test_bundles_files_as_tar_with_given_names
+    copy_compressible_file_to('somefiles', 'txt', compressed: true)
+    compressed_location = @location
+    copy_arbitrary_file_to('otherfiles', nil)
+
+    response = get :path => bundle_path([[:location, compressed_location], [:name, 'notes.txt'], [:location, @location], [:name, '../data/binary'], [:format, 'tar']]),
+                   :expected_content_type => 'application/x-tar'
+    assert_equal 'attachment; filename="bundle.tar"', response['content-disposition']
+    assert_equal({
+      'notes.txt' => File.read(fixture_file_path('compressible_file'), :mode => 'rb'),
+      'data/binary' => File.read(fixture_file_path('binary_file'), :mode => 'rb'),
+    }, tar_entries(response.body))
+  end
+
+  def test_bundles_files_as_zip_by_default
+    copy_arbitrary_file_to('somefiles', nil)
+    response = get :path => bundle_path([[:location, @location], [:filename, 'case 123.zip']]),
+                   :expected_content_type => 'application/zip'
+    assert_equal 'attachment; filename="case 123.zip"', response['content-disposition']
+    assert_equal "PK\x03\x04".b, response.body[0, 4]
+  end
+
+  def test_bundles_files_given_in_post_body
+    copy_arbitrary_file_to('somefiles', nil)
+    http = Net::HTTP.new(default_verm_spawner.hostname, default_verm_spawner.port)
+    response = http.post('/_bundle', URI.encode_www_form(:location => @location, :format => 'tar'), 'Content-Type' => 'application/x-www-form-urlencoded')
+    assert_equal 200, response.code.to_i
+    assert_equal({@location[1..-1] => File.read(fixture_file_path('binary_file'), :mode => 'rb')}, tar_entries(response.body))
+  end
+
+  def test_gives_404_before_starting_if_files_are_missing
+    copy_arbitrary_file_to('somefiles', nil)
+    response = get :path => bundle_path([[:location, @location], [:location, "/somefiles/#{@subdirectory}/x#{@filename}"]]),
+                   :expected_response_code => 404
+    assert_match "/somefiles/#{@subdirectory}/x#{@filename}", response.body
+  end
+
+  def test_fetches_missing_files_from_replicas
+    replica = spawn_verm(:verm_data => "#{default_verm_spawner.verm_data}_replica", :port => default_verm_spawner.port + 1)
+    front = spawn_verm(:verm_data => "#{default_verm_spawner.verm_data}_front", :port => default_verm_spawner.port + 2, :replicate_to => replica.host)
+    copy_compressible_file_to('somefiles', 'txt', compressed: true, spawner: replica)
+
+    response = get :path => bundle_path([[:location, @location], [:format, 'tar']]), :verm => front
+    assert_equal({@location[1..-1] => File.read(fixture_file_path('compressible_file'), :mode => 'rb')}, tar_entries(response.body))
+  end
+end
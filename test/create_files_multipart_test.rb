@@ -8,4 +8,16 @@ class CreateFilesMultipartTest < Verm::TestCase
   end
 
   include CreateFilesSharedTests
+
+  def test_remembers_uploaded_filenames_if_configured
+    location = post_file :path => '/foo', :file => 'simple_text_file', :type => 'text/plain'
+    assert_nil get(:path => location)['content-disposition']
+
+    teardown_verm
+    spawn_verm(:remember_filenames => true)
+    location = post_file :path => '/foo', :file => 'simple_text_file', :type => 'text/plain'
+    assert_equal 'inline; filename="simple_text_file"', get(:path => location)['content-disposition']
+    assert_equal 'attachment; filename="simple_text_file"', get(:path => "#{location}?download=1")['content-disposition']
+    assert_equal 'attachment; filename="other.txt"', get(:path => "#{location}?filename=other.txt")['content-disposition']
+  end
 end
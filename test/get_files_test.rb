@@ -82,6 +82,169 @@ class GetFilesTest < Verm::TestCase
           :expected_content => nil # and body not sent
     end
   end
+
+  def test_serves_files_with_quoted_etag_from_hash_and_supports_lists_and_weak_comparison
+    copy_arbitrary_file_to('somefiles', nil)
+    response = get :path => @location
+    assert_equal "\"#{@subdirectory}#{@filename}\"", response['etag']
+
+    get :path => @location,
+        :headers => {'if-none-match' => "\"foo\", W/#{response['etag']}"},
+        :expected_response_code => 304,
+        :expected_content => nil
+
+    get :path => @location,
+        :headers => {'if-none-match' => '"foo", "bar"'},
+        :expected_response_code => 200
+  end
+
+  def test_supports_if_match_and_if_unmodified_since
+    copy_arbitrary_file_to('somefiles', nil)
+    response = get :path => @location
+
+    get :path => @location,
+        :headers => {'if-match' => "\"foo\", #{response['etag']}"},
+        :expected_response_code => 200
+
+    get :path => @location,
+        :headers => {'if-match' => "W/#{response['etag']}"}, # If-Match uses strong comparison
+        :expected_response_code => 412
+
+    get :path => @location,
+        :headers => {'if-unmodified-since' => response['last-modified']},
+        :expected_response_code => 200
+
+    get :path => @location,
+        :headers => {'if-unmodified-since' => (Time.httpdate(response['last-modified']) - 1).httpdate},
+        :expected_response_code => 412
+  end
+
+  def test_supports_if_range_with_etags_and_dates
+    copy_arbitrary_file_to('somefiles', nil)
+    content = File.read(@original_file, :mode => 'rb')
+    response = get :path => @location
+
+    [response['etag'], response['last-modified']].each do |validator|
+      get :path => @location,
+          :headers => {'range' => 'bytes=0-9', 'if-range' => validator},
+          :expected_response_code => 206,
+          :expected_content => content[0..9]
+    end
+
+    ['"foo"', (Time.httpdate(response['last-modified']) - 1).httpdate].each do |validator|
+      get :path => @location,
+          :headers => {'range' => 'bytes=0-9', 'if-range' => validator},
+          :expected_response_code => 200,
+          :expected_content => content
+    end
+  end
+
+  def test_gives_weak_etags_to_compressed_responses
+    copy_compressible_file_to('somefiles', nil, compressed: true)
+    response = get :path => @location,
+                   :accept_encoding => 'gzip',
+                   :expected_content_encoding => 'gzip'
+    assert_equal "W/\"#{@subdirectory}#{@filename.chomp('.gz')}-gzip\"", response['etag']
+
+    # weak tags still validate cached copies
+    get :path => @location,
+        :accept_encoding => 'gzip',
+        :headers => {'if-none-match' => response['etag']},
+        :expected_response_code => 304
+
+    # but can't be used to resume downloads, since another server's compressed copy may differ
+    get :path => @location,
+        :accept_encoding => 'gzip',
+        :headers => {'range' => 'bytes=0-9', 'if-range' => response['etag']},
+        :expected_response_code => 200,
+        :expected_content => File.read(@original_file, :mode => 'rb')
+
+    # whereas the uncompressed contents always have the same tag
+    response = get :path => @location,
+                   :accept_encoding => 'none',
+                   :expected_content_encoding => nil
+    assert_equal "\"#{@subdirectory}#{@filename.chomp('.gz')}\"", response['etag']
+  end
+
+  def test_serves_digests_of_uncompressed_content
+    copy_compressible_file_to('somefiles', 'vermtest1', compressed: true)
+    expected = "sha-256=:#{Digest::SHA256.base64digest(File.read(@original_file.gsub('.gz', ''), :mode => 'rb'))}:"
+
+    response = get :path => @location,
+                   :accept_encoding => 'identity',
+                   :expected_content_encoding => nil
+    assert_equal expected, response['repr-digest']
+    assert_equal expected, response['content-digest']
+
+    response = get :path => @location,
+                   :headers => {'Range' => 'bytes=0-9'},
+                   :accept_encoding => 'identity',
+                   :expected_response_code => 206
+    assert_equal expected, response['repr-digest']
+    assert_nil response['content-digest']
+
+    # the digest is of the uncompressed content, so doesn't apply to the gzip-encoded representation
+    response = get :path => @location,
+                   :accept_encoding => 'gzip',
+                   :expected_content_encoding => 'gzip'
+    assert_nil response['repr-digest']
+  end
+
+  def test_quarantines_corrupt_files_if_verifying_reads
+    teardown_verm
+    spawn_verm(:verify_reads => true)
+    copy_arbitrary_file_to('somefiles', nil)
+    get :path => @location,
+        :expected_content => File.read(@original_file, :mode => 'rb')
+
+    data = File.read(@original_file, :mode => 'rb')
+    data.setbyte(100, data.getbyte(100) ^ 1)
+    File.open(File.join(@dest_subdirectory, @filename), 'wb') {|f| f.write(data)}
+
+    assert_statistics_change(:get_requests => 2, :get_requests_not_found => 1, :corrupt_files_quarantined => 1) do
+      # the end of the file is held back and the connection dropped
+      assert_raises(EOFError, Errno::ECONNRESET) { get :path => @location }
+
+      get :path => @location,
+          :expected_response_code => 404
+    end
+    assert File.exist?(File.join(default_verm_spawner.verm_data, '_verm', 'quarantine', 'somefiles', @subdirectory, @filename))
+  end
+
+  def test_sends_cache_control_if_configured
+    copy_arbitrary_file_to('somefiles', nil)
+    response = get :path => @location
+    assert_nil response['cache-control']
+
+    teardown_verm
+    spawn_verm(:cache_max_age => '31536000')
+    copy_arbitrary_file_to('somefiles', nil)
+    response = get :path => @location
+    assert_equal 'public, max-age=31536000, immutable', response['cache-control']
+
+    response = get :path => @location,
+                   :headers => {'if-none-match' => response['etag']},
+                   :expected_response_code => 304
+    assert_equal 'public, max-age=31536000, immutable', response['cache-control']
+  end
+
+  def test_sends_content_disposition_if_filename_or_download_requested
+    copy_arbitrary_file_to('somefiles', 'txt')
+    response = get :path => @location
+    assert_nil response['content-disposition']
+
+    response = get :path => "#{@location}?download=1"
+    assert_equal 'attachment', response['content-disposition']
+
+    response = get :path => "#{@location}?filename=Invoice%202024.pdf"
+    assert_equal 'attachment; filename="Invoice 2024.pdf"', response['content-disposition']
+
+    response = get :path => "#{@location}?filename=Invoice%202024.pdf&download=0"
+    assert_equal 'inline; filename="Invoice 2024.pdf"', response['content-disposition']
+
+    response = get :path => "#{@location}?filename=R%C3%A9sum%C3%A9.pdf"
+    assert_equal %q{attachment; filename="R_sum_.pdf"; filename*=UTF-8''R%C3%A9sum%C3%A9.pdf}, response['content-disposition']
+  end
   
   def test_serves_files_uncompressed_if_client_accepts_gzip_but_file_is_uncompressed
     copy_arbitrary_file_to('somefiles', 'vermtest1', compressed: false)
@@ -138,6 +301,36 @@ class GetFilesTest < Verm::TestCase
     end
   end
 
+  def test_serves_files_decompressed_if_client_refuses_gzip_and_file_is_compressed
+    copy_arbitrary_file_to('somefiles', 'vermtest1', compressed: true)
+    File.open(@original_file.gsub('.gz', ''), 'rb') do |f|
+      response = get :path => @location,
+                     :accept_encoding => 'gzip;q=0, deflate',
+                     :expected_content_encoding => nil,
+                     :expected_content_type => 'application/verm-test-file',
+                     :expected_content => f.read
+      assert_equal 'Accept-Encoding', response['vary']
+    end
+  end
+
+  def test_serves_compressible_files_compressed_if_enabled_and_client_accepts_gzip
+    teardown_verm
+    spawn_verm(:compress_responses_over => 1024)
+    copy_compressible_file_to('somefiles', 'txt')
+    content = File.read(@original_file, :mode => 'rb')
+
+    response = get :path => @location,
+                   :accept_encoding => 'gzip, deflate',
+                   :expected_content_encoding => 'gzip'
+    assert_equal 'Accept-Encoding', response['vary']
+    assert_equal content, ungzip(response.body)
+
+    get :path => @location,
+        :accept_encoding => 'gzip;q=0, deflate',
+        :expected_content_encoding => nil,
+        :expected_content => content
+  end
+
   def test_serves_fragments_of_decompressed_files_if_client_does_not_accept_gzip_and_file_is_compressed
     copy_compressible_file_to('somefiles', 'vermtest1', compressed: true)
     File.open(@original_file.gsub('.gz', ''), 'rb') do |f|
@@ -185,6 +378,70 @@ class GetFilesTest < Verm::TestCase
     end
   end
 
+  def test_serves_ranges_of_large_compressed_files_using_an_index
+    # alternate random data, which gets stored uncompressed, with text, which gets compressed, and
+    # make sure there's enough to need an index and several points to decompress from
+    random = Random.new(1)
+    text = File.read(fixture_file_path('compressible_file'), :mode => 'rb')
+    data = "".b
+    data << random.bytes(512*1024) << (text*6)[0, 512*1024] while data.bytesize < 12*1024*1024
+    output = StringIO.new("".b)
+    gz = Zlib::GzipWriter.new(output)
+    gz.orig_name = 'mixed_file' # sets the FNAME header field, which the index has to skip
+    gz.write(data)
+    gz.close
+    assert output.string.bytesize > 4*1024*1024
+
+    location = post_file :path => '/somefiles', :data => output.string, :encoding => 'gzip', :type => 'application/octet-stream',
+                         :expected_extension_suffix => 'gz'
+    index_filename = File.join(default_verm_spawner.verm_data, '_verm', 'gzip_index', "#{location}.idx")
+
+    ranges = [
+      [0, 100],
+      [4*1024*1024 - 50, 100],                  # across the first checkpoint
+      [4*1024*1024 - 300*1024, 600*1024],       # a larger span across it
+      [8*1024*1024 + 12345, 1000],              # just after the second
+      [data.bytesize - 1000, 1000],             # up to the end
+    ]
+    check_ranges = lambda do
+      ranges.each do |first, length|
+        response = get :path => location,
+                       :headers => {'Range' => "bytes=#{first}-#{first + length - 1}"},
+                       :accept_encoding => 'none',
+                       :expected_response_code => 206,
+                       :expected_content_encoding => nil,
+                       :expected_content => data[first, length]
+        assert_equal length, response.content_length
+        assert_equal "bytes #{first}-#{first + length - 1}/#{data.bytesize}", response['content-range']
+      end
+    end
+
+    check_ranges.call
+    assert File.exist?(index_filename)
+    index_mtime = File.mtime(index_filename)
+
+    # after a restart, the saved index should be used rather than built again
+    default_verm_spawner.stop_verm
+    default_verm_spawner.start_verm
+    default_verm_spawner.wait_until_available
+    check_ranges.call
+    assert_equal index_mtime, File.mtime(index_filename)
+  end
+
+  def test_gives_decompressed_length_for_head_requests_if_client_does_not_accept_gzip_and_file_is_compressed
+    copy_compressible_file_to('somefiles', 'vermtest1', compressed: true)
+    size = File.size(@original_file.gsub('.gz', ''))
+
+    request = Net::HTTP::Head.new(@location)
+    request['Accept-Encoding'] = 'none'
+    response = Net::HTTP.new(default_verm_spawner.hostname, default_verm_spawner.port).start do |connection|
+      connection.request(request)
+    end
+    assert_equal 200, response.code.to_i
+    assert_nil response['content-encoding']
+    assert_equal size, response.content_length
+  end
+
   def test_serves_files_compressed_if_client_requests_gz
     copy_arbitrary_file_to('somefiles', 'vermtest1', compressed: true)
     File.open(@original_file, 'rb') do |f|
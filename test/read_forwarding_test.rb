@@ -134,4 +134,43 @@ class ReadReplicationTest < Verm::TestCase
       end
     end
   end
+
+  def test_stops_forwarding_to_replicas_that_are_down
+    setup_replicas(0..1)
+    spawners[1].stop_verm
+
+    path = "/foo/IF/P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA"
+
+    assert_equal 1, get_statistics(:verm => spawners[0])[:"replica_localhost_#{port_for(1)}_up"]
+
+    3.times do
+      get :path => path, :expected_response_code => 404, :verm => spawners[0]
+    end
+
+    statistics = get_statistics(:verm => spawners[0])
+    assert_equal 0, statistics[:"replica_localhost_#{port_for(1)}_up"]
+    assert_equal 3, statistics[:"replica_localhost_#{port_for(1)}_consecutive_failures"]
+
+    # further requests aren't forwarded until the probe interval has passed
+    get :path => path, :expected_response_code => 404, :verm => spawners[0]
+    assert_equal 3, get_statistics(:verm => spawners[0])[:"replica_localhost_#{port_for(1)}_consecutive_failures"]
+  end
+
+  def test_reads_missing_files_from_replicas_in_the_same_locality_first
+    spawn_verm(:verm_data => "#{DEFAULT_VERM_SPAWNER_OPTIONS[:verm_data]}_replica0", :port => port_for(0), :locality => "here",
+               :replicate_to => ["localhost:#{port_for(1)}?locality=there", "localhost:#{port_for(2)}?locality=here"])
+    spawn_verm(:verm_data => "#{DEFAULT_VERM_SPAWNER_OPTIONS[:verm_data]}_replica1", :port => port_for(1))
+    spawn_verm(:verm_data => "#{DEFAULT_VERM_SPAWNER_OPTIONS[:verm_data]}_replica2", :port => port_for(2))
+
+    copy_arbitrary_file_to('somefiles', 'jpg', spawner: spawners[1])
+    copy_arbitrary_file_to('somefiles', 'jpg', spawner: spawners[2])
+
+    assert_statistics_changes spawners, [
+      {:get_requests => 1, :get_requests_found_on_replica => 1},
+      {},
+      {:get_requests => 1},
+    ] do
+      get :path => @location, :expected_content => File.read(fixture_file_path('binary_file'), :mode => 'rb'), :verm => spawners[0]
+    end
+  end
 end
@@ -0,0 +1,69 @@
+require File.expand_path(File.join(File.dirname(__FILE__), 'test_helper'))
+
+class RenditionsTest < Verm::TestCase
+  def setup
+    spawn_verm(:rendition_sizes => '100,200')
+    @location = post_file :path => '/photos', :file => 'jpeg', :type => 'image/jpeg', :expected_extension => 'jpg'
+  end
+
+  def png_dimensions(data)
+    assert_equal "\x89PNG".b, data[0, 4]
+    data[16, 8].unpack('NN')
+  end
+
+  def test_serves_resized_renditions_keeping_the_aspect_ratio
+    response = get :path => "#{@location}?w=200&format=png",
+                   :expected_content_type => 'image/png'
+    assert_equal [200, 149], png_dimensions(response.body)
+
+    response = get :path => "#{@location}?w=200&h=100&format=png"
+    assert_equal [134, 100], png_dimensions(response.body)
+
+    get :path => "#{@location}?w=100",
+        :expected_content_type => 'image/jpeg'
+
+    assert File.exist?(File.join(default_verm_spawner.verm_data, '_verm', 'renditions', @location, '200x0-contain.png'))
+  end
+
+  def test_serves_cropped_and_stretched_renditions
+    response = get :path => "#{@location}?w=100&h=100&fit=cover&format=png"
+    assert_equal [100, 100], png_dimensions(response.body)
+
+    response = get :path => "#{@location}?w=200&h=100&fit=fill&format=png"
+    assert_equal [200, 100], png_dimensions(response.body)
+  end
+
+  def test_sends_content_disposition_if_filename_or_download_requested
+    response = get :path => "#{@location}?w=200&filename=thumb.jpg"
+    assert_equal 'attachment; filename="thumb.jpg"', response['content-disposition']
+
+    response = get :path => "#{@location}?w=100&download=1"
+    assert_equal 'attachment', response['content-disposition']
+
+    # remembered filenames are given the extension for the rendition's format
+    teardown_verm
+    spawn_verm(:rendition_sizes => '100,200', :remember_filenames => true)
+    @multipart = true
+    location = post_file :path => '/photos', :file => 'jpeg', :type => 'image/jpeg', :expected_extension => 'jpg'
+    response = get :path => "#{location}?w=100&format=png&download=1",
+                   :expected_content_type => 'image/png'
+    assert_equal 'attachment; filename="jpeg.png"', response['content-disposition']
+  end
+
+  def test_rejects_sizes_that_arent_allowed
+    get :path => "#{@location}?w=150",
+        :expected_response_code => 400
+    get :path => "#{@location}?w=100&fit=stretch",
+        :expected_response_code => 400
+    get :path => "#{@location}?w=100&format=webp",
+        :expected_response_code => 400
+  end
+
+  def test_serves_the_original_if_renditions_arent_enabled
+    teardown_verm
+    spawn_verm
+    @location = post_file :path => '/photos', :file => 'jpeg', :type => 'image/jpeg'
+    get :path => "#{@location}?w=100",
+        :expected_content => File.read(fixture_file_path('jpeg'), :mode => 'rb')
+  end
+end
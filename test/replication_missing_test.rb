@@ -59,6 +59,40 @@ class ReplicationMissingTest < Verm::TestCase
     assert_gzipped_body paths[2..-1].join, put(:path => "/_missing", :data => gzip(paths.join), :type => "text/plain", :encoding => "gzip")
   end
 
+  def reconcile_headers
+    {'Authorization' => "Bearer #{DEFAULT_VERM_SPAWNER_OPTIONS[:admin_token]}"}
+  end
+
+  def test_lists_unmentioned_files_in_directories_when_reconciling
+    assert_gzipped_body "", put(:path => "/_missing", :data => "/foo/Sn/\r\n/foo/.\r\n", :type => "text/plain", :headers => reconcile_headers)
+
+    put_file :path => '/foo/Sn/Ei3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOw',
+             :file => 'simple_text_file',
+             :type => 'application/octet-stream'
+
+    # the caller doesn't have the subdirectory at all
+    assert_gzipped_body "+#{paths[0]}", put(:path => "/_missing", :data => "/foo/.\r\n", :type => "text/plain", :headers => reconcile_headers)
+
+    # the caller has the subdirectory, but not the file
+    assert_gzipped_body "", put(:path => "/_missing", :data => "/foo/Sn/\r\n/foo/.\r\n", :type => "text/plain", :headers => reconcile_headers)
+    assert_gzipped_body "+#{paths[0]}", put(:path => "/_missing", :data => "/foo/Sn/.\r\n", :type => "text/plain", :headers => reconcile_headers)
+
+    # the caller has the file, and we don't have its other file
+    assert_gzipped_body paths[1], put(:path => "/_missing", :data => (paths + ["/foo/Sn/.\r\n"]).join, :type => "text/plain", :headers => reconcile_headers)
+  end
+
+  def test_lists_nothing_when_reconciling_without_the_admin_token
+    put_file :path => '/foo/Sn/Ei3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOw',
+             :file => 'simple_text_file',
+             :type => 'application/octet-stream'
+
+    assert_gzipped_body "", put(:path => "/_missing", :data => "/foo/.\r\n", :type => "text/plain")
+    assert_gzipped_body "", put(:path => "/_missing", :data => "/foo/.\r\n", :type => "text/plain", :headers => {'Authorization' => "Bearer wrong-token"})
+
+    # the other lines are still answered as usual
+    assert_gzipped_body paths[1], put(:path => "/_missing", :data => (paths + ["/foo/Sn/.\r\n"]).join, :type => "text/plain")
+  end
+
   def test_supports_uncompressed_responses
     assert_gzipped_body   paths.join, put(:path => "/_missing", :data => paths.join, :type => "text/plain")
     assert_gzipped_body   paths.join, put(:path => "/_missing", :data => paths.join, :type => "text/plain", :accept_encoding => 'foo,gzip,bar')
@@ -202,4 +202,385 @@ class ReplicationPropagationTest < Verm::TestCase
     get :path => locations.shift, :expected_content => File.read(fixture_file_path('binary_file.gz'), :mode => 'rb'), :expected_content_type => "application/octet-stream", :expected_content_encoding => "gzip"
     get :path => locations.shift, :expected_content => File.read(fixture_file_path('simple_text_file.gz'), :mode => 'rb'), :expected_content_type => "application/gzip", :expected_content_encoding => nil
   end
+
+  def test_reports_resync_progress
+    @master.stop_verm
+    copy_arbitrary_file_to('foo', 'jpg', spawner: @master)
+    copy_compressible_file_to('bar', 'txt', spawner: @master)
+    @master.start_verm
+    @master.wait_until_available
+
+    status = nil
+    repeatedly_wait_until do
+      status = get_resync_status(@slave.host, :verm => @master)
+      status[:running] == 0 && status[:last_duration_seconds] > 0
+    end
+
+    assert status[:start_time_seconds] > 0
+    assert_equal 2, status[:files_scanned]
+    assert_equal 2, status[:missing_files]
+    assert status[:directories_scanned] >= 5 # the root, foo, bar and one subdirectory of each
+  end
+
+  def test_resyncs_periodically_if_scheduled
+    master = spawn_verm(
+      :verm_data => "#{@slave.verm_data}_replica2",
+      :port => @slave.port + 2,
+      :replicate_to => "#{@slave.host}?resync-interval=1s")
+
+    location = post_file(:path => '/foo',
+                         :file => 'simple_text_file',
+                         :type => 'text/plain',
+                         :verm => master)
+    repeatedly_wait_until { get_statistics(:verm => master)[:replication_push_attempts] == 1 }
+
+    # lose the file from the slave, which will only be noticed by a resync
+    @slave.stop_verm
+    @slave.clear_data
+    @slave.start_verm
+    @slave.wait_until_available
+
+    repeatedly_wait_until { get_statistics(:verm => master)[:replication_push_attempts] == 2 }
+    get :path => location, :expected_content => File.read(fixture_file_path('simple_text_file'), :mode => 'rb')
+  end
+
+  def test_scrubs_corrupt_files_and_replaces_them_from_replicas
+    scrubbed = spawn_verm(
+      :verm_data => "#{@slave.verm_data}_scrubbed",
+      :port => @slave.port + 2,
+      :replicate_to => @slave.host,
+      :scrub_interval => '1s')
+
+    location = post_file(:path => '/foo',
+                         :file => 'simple_text_file',
+                         :type => 'text/plain',
+                         :verm => scrubbed)
+    repeatedly_wait_until { get_statistics(:verm => scrubbed)[:replication_push_attempts] == 1 }
+
+    data = File.read(fixture_file_path('simple_text_file'), :mode => 'rb')
+    data.setbyte(0, data.getbyte(0) ^ 1)
+    File.open(File.join(scrubbed.verm_data, location), 'wb') {|f| f.write(data)}
+
+    repeatedly_wait_until { get_statistics(:verm => scrubbed)[:replication_pull_attempts] == 1 }
+    statistics = get_statistics(:verm => scrubbed)
+    assert_equal 1, statistics[:scrub_corrupt_files]
+    assert_equal 1, statistics[:corrupt_files_quarantined]
+    assert statistics[:scrub_last_pass_completed_timestamp_seconds] > 0
+    assert File.exist?(File.join(scrubbed.verm_data, '_verm', 'quarantine', location))
+    get :path => "#{location}?forward=0", :verm => scrubbed, :expected_content => File.read(fixture_file_path('simple_text_file'), :mode => 'rb')
+  end
+
+  def test_replicates_files_copied_into_the_data_directory_if_watching
+    skip "watching the data directory is only supported on Linux" unless RUBY_PLATFORM =~ /linux/
+    watched = spawn_verm(:verm_data => "#{@slave.verm_data}_watched", :port => @slave.port + 2, :replicate_to => @slave.host, :watch_data => true)
+    source = spawn_verm(:verm_data => "#{@slave.verm_data}_source", :port => @slave.port + 3)
+
+    location = post_file(:path => '/foo',
+                         :file => 'simple_text_file',
+                         :type => 'text/plain',
+                         :verm => source)
+    FileUtils.cp_r(File.join(source.verm_data, "foo"), watched.verm_data)
+
+    repeatedly_wait_until { get_statistics(:verm => @slave)[:put_requests_new_file_stored] > 0 }
+    get :path => "#{location}?forward=0", :verm => @slave, :expected_content => File.read(fixture_file_path('simple_text_file'), :mode => 'rb')
+  end
+
+  def test_requires_admin_token_for_admin_api
+    assert_equal "401", admin_request(:post, "/_admin/pause", "", @master, nil).code
+    assert_equal "401", admin_request(:post, "/_admin/pause", "", @master, "wrong").code
+
+    # the token must be given using the Bearer scheme
+    request = Net::HTTP::Post.new("/_admin/pause")
+    request['Authorization'] = DEFAULT_VERM_SPAWNER_OPTIONS[:admin_token]
+    assert_equal "401", Net::HTTP.start(@master.hostname, @master.port) {|http| http.request(request, "")}.code
+    request['Authorization'] = "Basic #{DEFAULT_VERM_SPAWNER_OPTIONS[:admin_token]}"
+    assert_equal "401", Net::HTTP.start(@master.hostname, @master.port) {|http| http.request(request, "")}.code
+    assert_equal 0, get_statistics(:verm => @master)[:"replication_#{@slave.hostname}_#{@slave.port}_paused"]
+  end
+
+  def test_pauses_and_force_replicates_through_admin_api
+    response = admin_request(:post, "/_admin/pause?target=#{@slave.host}", "", @master)
+    assert_equal "200", response.code
+    assert_equal 1, get_statistics(:verm => @master)[:"replication_#{@slave.hostname}_#{@slave.port}_paused"]
+
+    location = post_file(:path => '/foo',
+                         :file => 'simple_text_file',
+                         :type => 'text/plain',
+                         :verm => @master)
+    sleep 0.5
+    assert_equal 1, get_statistics(:verm => @master)[:"replication_#{@slave.hostname}_#{@slave.port}_queue_length"]
+    get :path => location, :expected_response_code => 404
+
+    response = admin_request(:post, "/_admin/resume?target=#{@slave.host}", "", @master)
+    assert_equal "200", response.code
+    repeatedly_wait_until { get_statistics(:verm => @master)[:replication_push_attempts] == 1 }
+    get :path => location, :expected_content => File.read(fixture_file_path('simple_text_file'), :mode => 'rb')
+
+    # replicating it again on request should resend it even though the slave already has it
+    response = admin_request(:post, "/_admin/replicate?target=#{@slave.host}", "#{location}\n", @master)
+    assert_equal "200", response.code
+    assert_equal [location], JSON.parse(response.body)[@slave.host]
+    repeatedly_wait_until { get_statistics(:verm => @master)[:replication_push_attempts] == 2 }
+
+    assert_equal "404", admin_request(:post, "/_admin/replicate", "/foo/nonexistent\n", @master).code
+  end
+
+  def test_lists_queued_files_and_worker_errors
+    @slave.stop_verm
+
+    location = post_file(:path => '/foo',
+                         :file => 'simple_text_file',
+                         :type => 'text/plain',
+                         :verm => @master)
+
+    queue = nil
+    repeatedly_wait_until do
+      queue = JSON.parse(admin_request(:get, "/_admin/queue", nil, @master).body)[@slave.host]
+      queue["workers"].any? {|worker| worker["location"] == location && worker["last_error"]}
+    end
+    assert_equal 1, queue["queue_length"]
+    assert_match(/connection refused/, queue["last_error"])
+
+    admin_request(:post, "/_admin/pause", "", @master)
+    other_location = post_file(:path => '/foo',
+                               :file => 'another_text_file',
+                               :type => 'text/plain',
+                               :expected_extension => "txt",
+                               :verm => @master)
+    queue = JSON.parse(admin_request(:get, "/_admin/queue", nil, @master).body)[@slave.host]
+    assert_equal [other_location], queue["new_files"]
+    assert_equal true, queue["paused"]
+  end
+
+  def test_replicates_large_and_missing_files_queued_behind_new_files
+    # restart with only a couple of workers, so that they have to share out the lanes
+    @master.stop_verm
+    @master.options[:replication_workers] = '2'
+    @master.start_verm
+    @master.wait_until_available
+
+    admin_request(:post, "/_admin/pause", "", @master)
+
+    # files already in the data directory are found by resyncing and queued as missing
+    copy_arbitrary_file_to('missing', 'jpg', spawner: @master)
+    copy_compressible_file_to('missing', 'txt', spawner: @master)
+    missing_locations = ["/missing/IF/P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA.jpg", "/missing/Ji/INTnAqomBtpYxwk2Qw5-Utzm-LKa6rLtnzrjNl9G7.txt"]
+    assert_equal "200", admin_request(:post, "/_admin/resync?target=#{@slave.host}", "", @master).code
+    queue = nil
+    repeatedly_wait_until do
+      queue = JSON.parse(admin_request(:get, "/_admin/queue", nil, @master).body)[@slave.host]
+      queue["missing_files"].size == missing_locations.size
+    end
+
+    large_data = Random.new(1).bytes(17*1024*1024)
+    large_location = post_file(:path => '/large', :data => large_data, :type => 'application/octet-stream', :verm => @master)
+    new_locations = (1..5).collect do |n|
+      post_file(:path => '/new', :data => "new file #{n}", :type => 'text/plain', :expected_extension => 'txt', :verm => @master)
+    end
+
+    queue = JSON.parse(admin_request(:get, "/_admin/queue", nil, @master).body)[@slave.host]
+    assert_equal new_locations.sort, queue["new_files"].sort
+    assert_equal missing_locations.sort, queue["missing_files"].sort
+    assert_equal [large_location], queue["large_files"]
+
+    admin_request(:post, "/_admin/resume", "", @master)
+    repeatedly_wait_until do
+      get_statistics(:verm => @master)[:"replication_#{@slave.hostname}_#{@slave.port}_queue_length"] == 0
+    end
+
+    new_locations.each_with_index {|location, index| get :path => location, :expected_content => "new file #{index + 1}"}
+    get :path => missing_locations[0], :expected_content => File.read(fixture_file_path('binary_file'), :mode => 'rb')
+    get :path => missing_locations[1], :expected_content => File.read(fixture_file_path('compressible_file'), :mode => 'rb')
+    get :path => large_location, :expected_content => large_data
+  end
+
+  def test_replicates_new_files_before_missing_files
+    # with a single worker, files reach the slave in the order they were taken off the queues
+    @master.stop_verm
+    @master.options[:replication_workers] = '1'
+    @master.options[:replication_min_workers] = '1'
+    @master.start_verm
+    @master.wait_until_available
+
+    admin_request(:post, "/_admin/pause", "", @master)
+
+    copy_arbitrary_file_to('missing', 'jpg', spawner: @master)
+    copy_compressible_file_to('missing', 'txt', spawner: @master)
+    missing_locations = ["/missing/IF/P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA.jpg", "/missing/Ji/INTnAqomBtpYxwk2Qw5-Utzm-LKa6rLtnzrjNl9G7.txt"]
+    assert_equal "200", admin_request(:post, "/_admin/resync?target=#{@slave.host}", "", @master).code
+    repeatedly_wait_until do
+      JSON.parse(admin_request(:get, "/_admin/queue", nil, @master).body)[@slave.host]["missing_files"].size == missing_locations.size
+    end
+
+    new_locations = (1..3).collect do |n|
+      post_file(:path => '/new', :data => "new file #{n}", :type => 'text/plain', :expected_extension => 'txt', :verm => @master)
+    end
+
+    admin_request(:post, "/_admin/resume", "", @master)
+    repeatedly_wait_until do
+      get_statistics(:verm => @master)[:"replication_#{@slave.hostname}_#{@slave.port}_queue_length"] == 0 &&
+        (new_locations + missing_locations).all? {|location| File.exist?(expected_filename(location, :verm => @slave))}
+    end
+
+    last_new_file = new_locations.collect {|location| File.mtime(expected_filename(location, :verm => @slave))}.max
+    first_missing_file = missing_locations.collect {|location| File.mtime(expected_filename(location, :verm => @slave))}.min
+    assert last_new_file < first_missing_file, "The missing files were replicated before the new files"
+  end
+
+  # a stand-in replica that takes its time over each request, and fails them all while @failing is set
+  def start_slow_replica(port, delay)
+    server = TCPServer.new('localhost', port)
+    Thread.new do
+      loop do
+        Thread.new(server.accept) do |socket|
+          begin
+            while request_line = socket.gets
+              headers = {}
+              while (line = socket.gets) && line != "\r\n"
+                name, value = line.split(":", 2)
+                headers[name.downcase] = value.strip
+              end
+              socket.read(headers['content-length'].to_i) if headers['content-length']
+              sleep delay
+              if @failing
+                socket.write "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n"
+              elsif request_line.start_with?("PUT /_missing")
+                socket.write "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+              else
+                socket.write "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"
+              end
+            end
+          rescue IOError, SystemCallError
+          ensure
+            socket.close rescue nil
+          end
+        end
+      end
+    end
+    server
+  end
+
+  def replication_workers(verm, target)
+    get(:path => "/_statistics", :verm => verm).body[/^verm_replication_workers\{target="#{Regexp.escape(target)}"\} (\d+)/, 1].to_i
+  end
+
+  def post_files_to_replicate(verm, count)
+    count.times do
+      # too big to be batched, so each is sent in its own request
+      post_file(:path => '/foo', :data => Random.new.bytes(100*1024), :type => 'application/octet-stream', :verm => verm)
+    end
+  end
+
+  def test_adjusts_replication_workers_to_the_target
+    replica_port = @slave.port + 3
+    replica = start_slow_replica(replica_port, 0.2)
+    master = spawn_verm(
+      :verm_data => "#{@slave.verm_data}_slow",
+      :port => @slave.port + 2,
+      :replicate_to => "localhost:#{replica_port}",
+      :replication_workers => '16',
+      :replication_min_workers => '1')
+    target = "localhost:#{replica_port}"
+    assert_equal 1, replication_workers(master, target)
+
+    # while the replica keeps up, more workers are started to get through the queue
+    post_files_to_replicate(master, 100)
+    repeatedly_wait_until { replication_workers(master, target) >= 4 }
+
+    # but when requests fail, the number is cut back
+    @failing = true
+    post_files_to_replicate(master, 20)
+    repeatedly_wait_until { replication_workers(master, target) == 1 }
+
+    # and ramps up again once the replica recovers
+    @failing = false
+    post_files_to_replicate(master, 100)
+    repeatedly_wait_until { replication_workers(master, target) >= 4 }
+  ensure
+    replica.close if replica
+  end
+
+  def test_keeps_replication_workers_when_the_mix_of_file_sizes_changes
+    # the slave has nothing else to do, so switching between sending small files and sending
+    # bigger ones shouldn't be mistaken for congestion
+    target = @slave.host
+    workers = [replication_workers(@master, target)]
+    6.times do |phase|
+      size = phase.even? ? 1024 : 900*1024
+      finish = Time.now + 2
+      while Time.now < finish
+        post_file(:path => '/foo', :data => Random.new.bytes(size), :type => 'application/octet-stream', :verm => @master)
+      end
+      workers << replication_workers(@master, target)
+    end
+
+    assert_equal workers.sort, workers, "The number of workers was cut back"
+    assert workers.last > workers.first, "The number of workers wasn't increased"
+  end
+
+  def test_propagates_files_compressed_on_the_wire_if_configured
+    master = spawn_verm(
+      :verm_data => "#{@slave.verm_data}_compressing",
+      :port => @slave.port + 2,
+      :replicate_to => "#{@slave.host}?compress=1")
+
+    # queue the files up so that the small ones are sent together in a batch
+    admin_request(:post, "/_admin/pause", "", master)
+    text = File.read(fixture_file_path('compressible_file'), :mode => 'rb')
+    files = {
+      post_file(:path => '/foo', :file => 'compressible_file', :type => 'text/plain', :expected_extension => 'txt', :verm => master) => text,
+      post_file(:path => '/foo', :data => text[0, 10000], :type => 'text/plain', :expected_extension => 'txt', :verm => master) => text[0, 10000],
+      post_file(:path => '/foo', :data => text[10000, 10000], :type => 'text/plain', :expected_extension => 'txt', :verm => master) => text[10000, 10000],
+    }
+
+    before = get_statistics
+    admin_request(:post, "/_admin/resume", "", master)
+    repeatedly_wait_until do
+      get_statistics(:verm => master)[:"replication_#{@slave.hostname}_#{@slave.port}_queue_length"] == 0
+    end
+    assert_equal 2, get_statistics[:put_requests_batched_files].to_i - before[:put_requests_batched_files].to_i
+
+    # the slave should store them just as they were uploaded
+    files.each do |location, data|
+      assert_equal data, File.read(File.join(@slave.verm_data, location), :mode => 'rb')
+      assert !File.exist?(File.join(@slave.verm_data, "#{location}.gz"))
+    end
+  end
+
+  def test_moves_files_rejected_by_slave_to_dead_letter_list
+    @master.stop_verm
+
+    # put some other content in place under the location for binary_file, as if the file had been corrupted on disk
+    copy_fixture_file_to('foo', nil, 'simple_text_file', 'IF', 'P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA', spawner: @master)
+
+    @master.start_verm
+    @master.wait_until_available
+
+    after = nil
+    repeatedly_wait_until do
+      after = get_statistics(:verm => @master)
+      after[:"replication_#{@slave.hostname}_#{@slave.port}_dead_letters"] == 1
+    end
+
+    # the job should have been given up on rather than retried forever
+    assert_equal 1, after[:replication_push_attempts]
+    assert_equal 1, after[:replication_push_attempts_failed]
+    assert_equal 0, after[:"replication_#{@slave.hostname}_#{@slave.port}_queue_length"]
+
+    response = admin_request(:get, "/_admin/dead_letters", nil, @master)
+    assert_equal "200", response.code
+    dead_letters = JSON.parse(response.body)[@slave.host]
+    assert_equal [@location], dead_letters.collect {|dead_letter| dead_letter["location"]}
+
+    # discarding needs either a list of locations or an explicit all=1
+    response = admin_request(:post, "/_admin/dead_letters?action=discard", "", @master)
+    assert_equal "400", response.code
+    assert_equal 1, get_statistics(:verm => @master)[:"replication_#{@slave.hostname}_#{@slave.port}_dead_letters"]
+
+    response = admin_request(:post, "/_admin/dead_letters?action=discard&all=1", "", @master)
+    assert_equal "200", response.code
+    assert_equal [@location], JSON.parse(response.body)[@slave.host]
+
+    assert_equal 0, get_statistics(:verm => @master)[:"replication_#{@slave.hostname}_#{@slave.port}_dead_letters"]
+  end
 end
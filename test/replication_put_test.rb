@@ -31,6 +31,24 @@ class ReplicationPutTest < Verm::TestCase
     end
   end
 
+  def test_saves_files_compressed_on_the_wire_uncompressed
+    file_data = fixture_file_data('simple_text_file')
+    response = put(:path => '/foo/Sn/Ei3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOw.txt',
+                   :data => gzip(file_data),
+                   :type => 'application/octet-stream',
+                   :headers => {'Verm-Transfer-Encoding' => 'gzip'})
+    assert_equal '/foo/Sn/Ei3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOw.txt', response['location']
+    assert_equal file_data, File.read(File.join(DEFAULT_VERM_SPAWNER_OPTIONS[:verm_data], response['location']), :mode => 'rb')
+  end
+
+  def test_returns_digest_of_saved_file
+    file_data = fixture_file_data('simple_text_file')
+    response = put(:path => '/foo/Sn/Ei3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOw.txt',
+                   :data => file_data,
+                   :type => 'text/plain')
+    assert_equal "sha-256=:#{Digest::SHA256.base64digest(file_data)}:", response['repr-digest']
+  end
+
   def test_saves_binary_files_without_truncation_or_miscoding
     put_file :path => '/foo/IF/P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA',
              :file => 'binary_file',
@@ -130,4 +148,86 @@ class ReplicationPutTest < Verm::TestCase
              :file => 'simple_text_file',
              :type => 'application/octet-stream'
   end
+
+  def test_resumes_interrupted_uploads
+    path = '/foo/IF/P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA'
+    file_data = fixture_file_data('binary_file')
+    dir = File.join(default_verm_spawner.verm_data, 'foo')
+
+    socket = TCPSocket.new(default_verm_spawner.hostname, default_verm_spawner.port)
+    socket.write "PUT #{path} HTTP/1.0\r\n"
+    socket.write "Content-Type: application/octet-stream\r\n"
+    socket.write "Content-Range: bytes 0-#{file_data.size - 1}/#{file_data.size}\r\n"
+    socket.write "Content-Length: #{file_data.size}\r\n"
+    socket.write "\r\n"
+    socket.write file_data[0...100]
+    repeatedly_wait_until { Dir["#{dir}/_upload*"].size > 0 }
+    socket.close
+
+    # the data received so far should be kept for the sender to resume from
+    repeatedly_wait_until { File.size?("#{dir}/_upload_partial_IF_P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA") == 100 }
+    response = get(:path => "/_partial#{path}")
+    assert_equal "100", response['upload-offset']
+
+    response = put(:path => path,
+                   :data => file_data[100..-1],
+                   :type => 'application/octet-stream',
+                   :headers => {'Content-Range' => "bytes 100-#{file_data.size - 1}/#{file_data.size}"})
+    assert_equal path, response['location']
+    assert_equal file_data, File.read(expected_filename(path), :mode => 'rb')
+    assert_equal [], Dir["#{dir}/_upload*"]
+  end
+
+  def test_removes_partial_uploads_when_the_file_arrives_another_way
+    path = '/foo/IF/P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA'
+    dir = File.join(default_verm_spawner.verm_data, 'foo')
+    FileUtils.mkdir_p(dir)
+    File.write("#{dir}/_upload_partial_IF_P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA", fixture_file_data('binary_file')[0...100])
+
+    put_file :path => path,
+             :file => 'binary_file',
+             :type => 'application/octet-stream'
+    assert_equal [], Dir["#{dir}/_upload*"]
+  end
+
+  def test_expires_old_partial_uploads
+    dir = File.join(default_verm_spawner.verm_data, 'foo')
+    FileUtils.mkdir_p(dir)
+    old_partial = "#{dir}/_upload_partial_IF_P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA"
+    recent_partial = "#{dir}/_upload_partial_Sn_Ei3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOw"
+    File.write(old_partial, "old data")
+    File.write(recent_partial, "recent data")
+    File.utime(Time.now - 8*24*60*60, Time.now - 8*24*60*60, old_partial)
+
+    # abandoned partial uploads are removed when a resync comes across them
+    replica = spawn_verm(:verm_data => "#{default_verm_spawner.verm_data}_replica", :port => default_verm_spawner.port + 1)
+    default_verm_spawner.stop_verm
+    default_verm_spawner.options[:replicate_to] = replica.host
+    default_verm_spawner.start_verm
+    default_verm_spawner.wait_until_available
+
+    repeatedly_wait_until { !File.exist?(old_partial) }
+    assert File.exist?(recent_partial)
+  end
+
+  def test_saves_batches_of_files
+    io = StringIO.new("".force_encoding("binary"))
+    Gem::Package::TarWriter.new(io) do |tar|
+      tar.add_file_simple('/foo/Sn/Ei3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOw', 0644, fixture_file_data('simple_text_file').size) {|f| f.write fixture_file_data('simple_text_file')}
+      tar.add_file_simple('/foo/Sn/Ui3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOx', 0644, fixture_file_data('simple_text_file').size) {|f| f.write fixture_file_data('simple_text_file')}
+      tar.add_file_simple('/foo/IF/P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA.jpg', 0644, fixture_file_data('binary_file').size) {|f| f.write fixture_file_data('binary_file')}
+    end
+
+    assert_statistics_change(:put_requests => 1, :put_requests_batched_files => 3, :put_requests_new_file_stored => 2, :put_requests_failed => 1) do
+      response = put(:path => '/_batch', :data => io.string, :type => 'application/x-tar')
+      assert_equal [
+        "201 /foo/Sn/Ei3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOw",
+        "422 /foo/Sn/Ui3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOx /foo/Sn/Ui3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOx is not the correct location, is the file corrupt?",
+        "201 /foo/IF/P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA.jpg",
+      ], response.body.split("\r\n")
+    end
+
+    assert_equal fixture_file_data('simple_text_file'), File.read(expected_filename('/foo/Sn/Ei3p5f7Ht82wQtJ_PG7ostrwGnYwPZatsV0T3HBOw'), :mode => 'rb')
+    assert_equal fixture_file_data('binary_file'), File.read(expected_filename('/foo/IF/P8unS2JIuR6_UZI5pZ0lxWHhfvR2ocOcRAma_lEiA.jpg'), :mode => 'rb')
+  end
 end
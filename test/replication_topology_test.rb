@@ -54,6 +54,39 @@ class ReplicationTopologyTest < Verm::TestCase
     ], changes)
   end
 
+  def test_pulls_files_from_replicas_that_dont_replicate_back_when_reconciling
+    spawn_verm(:verm_data => "#{DEFAULT_VERM_SPAWNER_OPTIONS[:verm_data]}_replica0", :port => port_for(0))
+    post_something_to(spawners[0])
+
+    spawn_verm(:verm_data => "#{DEFAULT_VERM_SPAWNER_OPTIONS[:verm_data]}_replica1", :port => port_for(1), :replicate_to => "localhost:#{port_for(0)}?reconcile=1")
+
+    repeatedly_wait_until do
+      get_statistics(:verm => spawners[1])[:replication_pull_attempts] > 0
+    end
+
+    # the second replica should now have its own copy, without needing to forward the read
+    get get_options.merge(:verm => spawners[1], :path => "#{@location}?forward=0")
+    assert_equal 0, get_statistics(:verm => spawners[1])[:replication_pull_attempts_failed]
+  end
+
+  def test_diffs_files_on_replicas
+    0.upto(1) do |n|
+      spawn_verm(:verm_data => "#{DEFAULT_VERM_SPAWNER_OPTIONS[:verm_data]}_replica#{n}", :port => port_for(n))
+    end
+    post_something_to(spawners[1])
+
+    diff = [spawners[0].verm_binary, "diff", "-admin-token", DEFAULT_VERM_SPAWNER_OPTIONS[:admin_token], spawners[0].host, spawners[1].host]
+    output = IO.popen(diff, &:read)
+    assert_equal 1, $?.exitstatus
+    assert_equal "> #{@location}\n0 only on #{spawners[0].host}, 1 only on #{spawners[1].host}, 0 on both\n", output
+
+    # local data directories can be compared too
+    post_something_to(spawners[0])
+    output = IO.popen([spawners[0].verm_binary, "diff", "-counts-only", spawners[0].verm_data, spawners[1].verm_data], &:read)
+    assert_equal 0, $?.exitstatus
+    assert_equal "0 only on #{spawners[0].verm_data}, 0 only on #{spawners[1].verm_data}, 1 on both\n", output
+  end
+
   def test_propagates_around_closed_loop
     0.upto(2) do |n|
       replicate_to = n.zero? ? "localhost:#{port_for(2)}" : "localhost:#{port_for(n - 1)}"
@@ -1,5 +1,9 @@
 require 'minitest/autorun'
 require 'fileutils'
+require 'json'
+require 'time'
+require 'digest'
+require 'rubygems/package'
 require 'byebug'
 require File.expand_path(File.join(File.dirname(__FILE__), 'net_http_multipart_post'))
 require File.expand_path(File.join(File.dirname(__FILE__), 'verm_spawner'))
@@ -18,6 +22,8 @@ DEFAULT_VERM_SPAWNER_OPTIONS = {
   :port => 3405,
 
   :quiet => true,
+
+  :admin_token => "test-admin-token",
 }
 
 module Verm
@@ -217,12 +223,21 @@ module Verm
       location
     end
     
+    def admin_request(method, path, body = nil, verm_spawner = default_verm_spawner, token = DEFAULT_VERM_SPAWNER_OPTIONS[:admin_token])
+      request = Net::HTTP.const_get(method.capitalize).new(path)
+      request['Authorization'] = "Bearer #{token}" if token
+      http = Net::HTTP.new(verm_spawner.hostname, verm_spawner.port)
+      http.read_timeout = timeout
+      http.start {|connection| connection.request(request, body)}
+    end
+
     def put(options, verm_spawner = default_verm_spawner)
       file_data = options[:data] || fixture_file_data(options[:file])
       
       request = Net::HTTP::Put.new(options[:path])
       request.content_type = options[:type] if options[:type]
       request['Content-Encoding'] = options[:encoding] if options[:encoding]
+      options[:headers].each {|k, v| request[k] = v} if options[:headers]
       request['Accept-Encoding'] = options[:accept_encoding] # even if not set, write a nil to disable decode_content
       assert !request.decode_content, "disabling decode_content failed!"
       
@@ -254,9 +269,19 @@ module Verm
         lines = response.body.split(/\n/)
         # Ignore new Prometheus comment lines
         lines.reject! { |line| line[0] == "#" }
+        # Ignore resync progress, which depends on when the initial resyncs happen to finish; tests
+        # that care about it use get_resync_status
+        lines.reject! { |line| line =~ /^verm_replication_resync_/ }
+        # Ignore the per-lane breakdown of the queue, which depends on which jobs workers happen to have
+        # taken; the total is still given by replication_queue_length
+        lines.reject! { |line| line =~ /^verm_replication_lane_/ }
+        # Ignore the number of workers, which is adjusted automatically as replication goes on
+        lines.reject! { |line| line =~ /^verm_replication_workers/ }
         # Rewrite the new Prometheus format of replication_queue_length to something the tests understand
         lines.each do |line|
           line.gsub!(/replication_queue_length{target="(\w+):(\d+)"} (\d+)/, 'replication_\1_\2_queue_length \3')
+          line.gsub!(/verm_replica_(\w+){target="(\w+):(\d+)"} (\d+)/, 'replica_\2_\3_\1 \4')
+          line.gsub!(/verm_replication_(\w+){target="(\w+):(\d+)"} (\d+)/, 'replication_\2_\3_\1 \4')
           line.gsub!(/verm_|_total/, '')
         end
         results = lines.inject({}) {|res, line| name, value = line.split(/ /); res[name.to_sym] = value.to_i; res}
@@ -271,6 +296,11 @@ module Verm
       end
     end
 
+    def get_resync_status(target, options = {})
+      response = get(options.merge(:path => "/_statistics", :expected_response_code => 200))
+      response.body.scan(/^verm_replication_resync_(\w+){target="#{target}"} ([\d.]+)$/).inject({}) {|res, (name, value)| res[name.to_sym] = value.to_f; res}
+    end
+
     def calculate_statistics_change(before, after)
       after.inject({}) {|results, (k, v)| results[k] = v - before[k] unless v == before[k]; results}
     end
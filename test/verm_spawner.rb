@@ -41,7 +41,7 @@ class VermSpawner
 
     @options.each do |name, value|
       option = "--#{name.to_s.gsub("_", "-")}"
-      exec_args += [option, value]
+      exec_args += (value == true ? [option] : [option, value])
     end
 
     if @replicate_to
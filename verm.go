@@ -33,29 +33,81 @@ func default_root() string {
 }
 
 func main() {
-	var rootDataDirectory, listenAddress, port, mimeTypesFile string
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		os.Exit(diffCommand(os.Args[2:]))
+	}
+
+	var rootDataDirectory, stateDirectory, listenAddress, port, mimeTypesFile, adminToken string
 	var mimeTypesClear bool
 	var replicationTargets ReplicationTargets
 	var replicationWorkers int
 	var healthCheckPath, healthyIfFile, healthyUnlessFile string
-	var quiet bool
+	var watchData, quiet bool
+	var compressResponsesOver int64
+	var cacheMaxAge int
+	var verifyReads bool
+	var rememberFilenames bool
+	var scrubInterval time.Duration
+	var scrubRate int64
+	var renditionSizes []int
 
 	flag.StringVar(&rootDataDirectory, "data", default_root(), "Sets the root data directory to /foo.  Must be fully-qualified (ie. it must start with a /).")
+	flag.StringVar(&stateDirectory, "state", "", "Sets the directory Verm keeps its own state in, such as the list of files that couldn't be replicated.  Default: the _verm subdirectory of the root data directory.")
 	flag.StringVar(&listenAddress, "listen", DefaultListenAddress, "Listen on the given IP address.  Default: listen on all network interfaces.")
 	flag.StringVar(&port, "port", DefaultPort, "Listen on the given port.")
 	flag.StringVar(&mimeTypesFile, "mime-types-file", DefaultMimeTypesFile, "Load MIME content-types from the given file.")
 	flag.BoolVar(&mimeTypesClear, "no-default-mime-types", false, "Clear the built-in MIME types so the settings in the file given in the mime-types-file option are used exclusively.")
 	flag.Var(&replicationTargets, "replicate-to", "Replicate files to the given Verm server.  May be given multiple times.")
-	flag.IntVar(&replicationWorkers, "replication-workers", runtime.NumCPU()*10, "Number of gophers to use to replicate files to each Verm server.  Generally should be large; the default scales with the number of CPUs detected.")
+	flag.StringVar(&replicationTargets.Locality, "locality", "", "The datacentre or zone this server is in.  Missing files are requested from replicas with the same locality first, and only from others if they are slow to respond or don't have the file.")
+	flag.Func("resync-interval", "Resync to each replica this often, eg. 6h, as well as at startup and on SIGUSR1.  Each time is varied slightly so servers don't all resync at once.  May be overridden for individual replicas using the resync-interval option to replicate-to.  Default: don't resync periodically.", replicationTargets.ResyncSchedule.SetInterval)
+	flag.Func("resync-window", "Resync to each replica once a day at a random time in the given window, eg. 01:00-05:00 (local time), instead of every resync-interval.  May be overridden for individual replicas using the resync-window option to replicate-to.", replicationTargets.ResyncSchedule.SetWindow)
+	flag.IntVar(&replicationWorkers, "replication-workers", runtime.NumCPU()*10, "Maximum number of gophers to use to replicate files to each Verm server.  The number used is adjusted automatically based on how quickly each server responds, so this should generally be large; the default scales with the number of CPUs detected.")
+	flag.IntVar(&replicationTargets.MinWorkers, "replication-min-workers", DefaultReplicationMinWorkers, "Minimum number of gophers to use to replicate files to each Verm server.")
+	flag.StringVar(&adminToken, "admin-token", "", "Enable the admin API under /_admin/, and require clients to give this token as an Authorization: Bearer header.  Default: the admin API is disabled.")
+	flag.IntVar(&replicationTargets.LaneShares.Missing, "replication-missing-share", DefaultReplicationMissingShare, "Percentage of each Verm server's replication workers to dedicate to files found to be missing by resyncs.  These workers also replicate newly-uploaded files when there are no missing files, and vice versa for the remaining workers.")
+	flag.IntVar(&replicationTargets.LaneShares.Large, "replication-large-share", DefaultReplicationLargeShare, "Percentage of each Verm server's replication workers to dedicate to large files, which no other workers replicate (so that large files can't hold up everything else).  At least one worker is always dedicated to large files.")
+	flag.BoolVar(&watchData, "watch-data", false, "Watch the data directory for files copied or moved into it directly, such as when restoring from a backup, and replicate them if their names match their contents.  Otherwise such files are only noticed by the next resync.  Only supported on Linux.")
+	flag.Int64Var(&compressResponsesOver, "compress-responses-over", 0, "Compress files of compressible types, such as text, that are at least this many bytes in size and aren't stored compressed when sending them to clients that accept gzip.  Default: 0, don't compress files that aren't stored compressed.")
+	flag.BoolVar(&verifyReads, "verify-reads", false, "Check files against the hash in their location as they're sent to clients, and if they don't match, drop the connection before the end of the file and move the file to the quarantine subdirectory of the state directory.  Byte range requests aren't checked.")
+	flag.BoolVar(&rememberFilenames, "remember-filenames", false, "Remember the original filenames of files uploaded from browser forms, in the filenames subdirectory of the state directory, and give them in a Content-Disposition header when the files are served.  The filenames aren't replicated.")
+	flag.DurationVar(&scrubInterval, "scrub-interval", 0, "Rehash every stored file this often, eg. 720h, in the background, and move any that don't match their location to the quarantine subdirectory of the state directory and fetch good copies from the replicas.  Default: don't scrub files.")
+	flag.Int64Var(&scrubRate, "scrub-rate", DefaultScrubRate, "Maximum number of bytes per second to read when scrubbing files.")
+	flag.Func("rendition-sizes", "Allow resized renditions of JPEG, PNG and GIF images to be requested using w and h parameters, eg. ?w=200&h=200&fit=cover, if the width and height are both in this comma-separated list of sizes, eg. 100,200,800.  Renditions are cached in the renditions subdirectory of the state directory.  Default: renditions are disabled.", func(value string) (err error) {
+		renditionSizes, err = ParseRenditionSizes(value)
+		return
+	})
+	flag.IntVar(&cacheMaxAge, "cache-max-age", 0, "Tell clients and caches that they can keep files for this many seconds without checking back, using a Cache-Control: public, max-age=..., immutable header.  Default: 0, don't send Cache-Control headers.")
 	flag.BoolVar(&quiet, "quiet", false, "Quiet mode.  Don't print startup/shutdown/request log messages to stdout.")
 	flag.StringVar(&healthCheckPath, "health-check-path", "", "Treat requests to this path as health checks from your load balancer, and give a 200 response without trying to serve a file.")
 	flag.StringVar(&healthyIfFile, "healthy-if-file", "", "Respond to requests to the health-check-path with a 503 response code if this file doesn't exist.")
 	flag.StringVar(&healthyUnlessFile, "healthy-unless-file", "", "Respond to requests to the health-check-path with a 503 response code if this file exists.")
-	flag.VisitAll(setFlagFromEnvironment)
+	setFlagsFromEnvironment(flag.CommandLine)
 	flag.Parse()
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	if replicationWorkers < 1 || replicationTargets.MinWorkers < 1 {
+		fmt.Fprintf(os.Stderr, "There must be at least one replication worker\n")
+		os.Exit(2)
+	}
+	if scrubInterval > 0 && scrubRate < 1 {
+		fmt.Fprintf(os.Stderr, "The scrub rate must be at least 1 byte per second\n")
+		os.Exit(2)
+	}
+	if err := replicationTargets.LaneShares.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(2)
+	}
+	if replicationTargets.reconciling() && adminToken == "" {
+		fmt.Fprintf(os.Stderr, "The reconcile option requires the admin-token option, as replicas only list their files for servers that give their admin token\n")
+		os.Exit(2)
+	}
+	replicationTargets.AdminToken = adminToken
+
+	if stateDirectory == "" {
+		stateDirectory = rootDataDirectory + DefaultStateSubdirectory
+	}
+
 	mimeext.LoadMimeFile(mimeTypesFile, mimeTypesClear)
 
 	listener, err := net.Listen("tcp", listenAddress+":"+port)
@@ -68,9 +120,26 @@ func main() {
 	}
 
 	statistics := NewLogStatistics()
-	server := VermServer(listener, rootDataDirectory, &replicationTargets, statistics, quiet)
-	replicationTargets.Start(rootDataDirectory, statistics, replicationWorkers)
+	server := VermServer(listener, rootDataDirectory, stateDirectory, adminToken, &replicationTargets, statistics, quiet)
+	server.CompressResponsesOver = compressResponsesOver
+	server.CacheMaxAge = cacheMaxAge
+	server.VerifyReads = verifyReads
+	server.RememberFilenames = rememberFilenames
+	if len(renditionSizes) != 0 {
+		server.Renditions = NewRenditionMaker(stateDirectory+RenditionSubdirectory, renditionSizes)
+	}
+	replicationTargets.Store = server.storeReplicatedFile
+	replicationTargets.Start(rootDataDirectory, stateDirectory, statistics, replicationWorkers, quiet)
 	replicationTargets.EnqueueResync()
+	if scrubInterval > 0 {
+		StartScrubber(server, scrubInterval, scrubRate)
+	}
+	if watchData {
+		if err := WatchDataDirectory(rootDataDirectory, stateDirectory, &replicationTargets, quiet); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't watch the data directory: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
 	done := make(chan interface{})
 	go waitForSignals(&server, &replicationTargets, done)
 
@@ -129,9 +198,11 @@ func waitForSignals(server *vermServer, targets *ReplicationTargets, done chan i
 	}
 }
 
-func setFlagFromEnvironment(f *flag.Flag) {
-	env := "VERM_" + strings.Replace(strings.ToUpper(f.Name), "-", "_", -1)
-	if os.Getenv(env) != "" {
-		flag.Set(f.Name, os.Getenv(env))
-	}
+func setFlagsFromEnvironment(flags *flag.FlagSet) {
+	flags.VisitAll(func(f *flag.Flag) {
+		env := "VERM_" + strings.Replace(strings.ToUpper(f.Name), "-", "_", -1)
+		if os.Getenv(env) != "" {
+			flags.Set(f.Name, os.Getenv(env))
+		}
+	})
 }